@@ -9,6 +9,7 @@ require (
 	github.com/mattn/go-isatty v0.0.20
 	github.com/sashabaranov/go-openai v1.32.5
 	github.com/spf13/cobra v1.8.1
+	golang.org/x/term v0.1.0
 )
 
 require (
@@ -16,5 +17,4 @@ require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.25.0 // indirect
-	golang.org/x/term v0.1.0 // indirect
 )
@@ -1,31 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"github.com/briandowns/spinner"
 	"github.com/fatih/color"
 	"github.com/mattn/go-isatty"
 	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/term"
 )
 
 type Config struct {
+	Version  int            `toml:"version"` // Schema version, see configVersion
 	AI       AIConfig       `toml:"ai"`
 	Commit   CommitConfig   `toml:"commit"`
 	System   SystemConfig   `toml:"system"`
@@ -34,39 +51,110 @@ type Config struct {
 }
 
 type AIConfig struct {
-	Provider    string  `toml:"provider"` // "openai" or "ollama"
-	Model       string  `toml:"model"`
-	MaxTokens   int     `toml:"max_tokens"`
-	Temperature float32 `toml:"temperature"`
+	Provider        string      `toml:"provider"` // "openai", "ollama" or "gemini"
+	Model           string      `toml:"model"`
+	MaxTokens       int         `toml:"max_tokens"`
+	MaxPromptTokens int         `toml:"max_prompt_tokens"` // Estimated prompt size to stay under by dropping the smallest diffs, 0 for no limit
+	Temperature     float32     `toml:"temperature"`
+	PromptTemplate  string      `toml:"prompt_template"` // text/template for the rules given to the model; empty uses the built-in rules
+	DefaultProfile  string      `toml:"default_profile"` // Profile applied when --profile is not given
+	Profiles        []AIProfile `toml:"profiles"`
 
 	Ollama struct {
 		URL string `toml:"url"`
 	} `toml:"ollama"`
+
+	OpenAI struct {
+		PricePer1k float64 `toml:"price_per_1k"` // USD per 1,000 tokens, used for cost estimates
+		BaseURL    string  `toml:"base_url"`     // OpenAI-compatible endpoint; empty means api.openai.com
+		APIKeyEnv  string  `toml:"api_key_env"`  // Env var holding the key; falls back to OPENAI_API_KEY
+		KeyFile    string  `toml:"key_file"`     // File containing the key
+		KeyCommand string  `toml:"key_command"`  // Shell command printing the key, e.g. a keychain lookup
+	} `toml:"openai"`
+}
+
+// AIProfile is a named set of AI settings selected with --profile. Unset
+// fields keep the values from [ai].
+type AIProfile struct {
+	Name        string   `toml:"name"`
+	Provider    string   `toml:"provider"`
+	Model       string   `toml:"model"`
+	MaxTokens   int      `toml:"max_tokens"`
+	Temperature *float32 `toml:"temperature"` // A pointer so 0 can be set
 }
 
 type CommitConfig struct {
-	Style              string   `toml:"style"`        // "conventional" or "detailed" or "custom"
-	IncludeScope       bool     `toml:"scope"`        // Include scope in conventional commits
-	IncludeBreaking    bool     `toml:"breaking"`     // Include breaking changes section
-	MaxLength          int      `toml:"max_length"`   // Maximum length of commit message
-	ScopePrefix        []string `toml:"scope_prefix"` // Allowed scope prefixes
-	JiraIntegration    bool     `toml:"jira"`         // Include JIRA ticket from branch name
-	CoAuthors          []string `toml:"co_authors"`   // List of co-authors to include
-	SignCommits        bool     `toml:"sign"`         // GPG sign commits
-	EmojisEnabled      bool     `toml:"emojis"`       // Use emojis in commits
-	VerifyConventional bool     `toml:"verify"`       // Verify conventional commit format
+	Style              string      `toml:"style"`                // "conventional" or "detailed" or "custom"
+	IncludeScope       bool        `toml:"scope"`                // Include scope in conventional commits
+	IncludeBreaking    bool        `toml:"breaking"`             // Include breaking changes section
+	MaxLength          int         `toml:"max_length"`           // Column the body is wrapped at
+	SubjectMaxLength   int         `toml:"subject_max_length"`   // Subject length to aim for; longer subjects only warn
+	ScopePrefix        []string    `toml:"scope_prefix"`         // Allowed scope prefixes
+	AllowedScopes      []string    `toml:"allowed_scopes"`       // Allowed scopes; globs like "web/*" match nested scopes
+	Commitlint         bool        `toml:"commitlint"`           // Take scope_prefix and allowed_scopes from the repo's commitlint config
+	JiraIntegration    bool        `toml:"jira"`                 // Include JIRA ticket from branch name
+	JiraPattern        string      `toml:"jira_pattern"`         // Regex used to extract the JIRA ticket
+	JiraURL            string      `toml:"jira_url"`             // JIRA base URL for fetching ticket summaries; token from JIRA_API_TOKEN
+	JiraEmail          string      `toml:"jira_email"`           // Account email for JIRA Cloud basic auth; bearer auth when empty
+	JiraTrailer        string      `toml:"jira_trailer"`         // Trailer key such as "Refs" or "Closes" for the ticket summary
+	IssueTracker       string      `toml:"issue_tracker"`        // "jira", "github" or "gitlab"
+	CoAuthors          []string    `toml:"co_authors"`           // List of co-authors to include
+	Footers            []string    `toml:"footers"`              // "Key: value" trailers added to every commit; values are templates over the message
+	SignCommits        bool        `toml:"sign"`                 // Sign commits
+	Signoff            bool        `toml:"signoff"`              // Add a DCO Signed-off-by trailer from git's user.name and user.email
+	PostProcessCommand string      `toml:"post_process_command"` // Shell command that gets the final message on stdin and prints the replacement
+	SignFormat         string      `toml:"sign_format"`          // "gpg" (default) or "ssh"
+	AttachNote         bool        `toml:"attach_note"`          // Record generation metadata in refs/notes/zing
+	EmojisEnabled      bool        `toml:"emojis"`               // Use emojis in commits
+	EmojiStyle         string      `toml:"emoji_style"`          // "conventional" or "gitmoji"
+	VerifyConventional bool        `toml:"verify"`               // Verify conventional commit format
+	SubjectPrefix      string      `toml:"subject_prefix"`       // Template prepended to the subject
+	SubjectSuffix      string      `toml:"subject_suffix"`       // Template appended to the subject
+	TypeRules          []TypeRule  `toml:"type_rules"`           // Path rules that pin the commit type
+	TypeFromBranch     string      `toml:"type_from_branch"`     // "suggest" or "enforce" the type from a branch prefix like fix/
+	WrapBody           bool        `toml:"wrap_body"`            // Hard-wrap body paragraphs at max_length; lists, code and footers are kept as is
+	Rules              CommitRules `toml:"rules"`                // Extra checks applied when verify is on
+	HistoryContext     int         `toml:"history_context"`      // Recent commit subjects shown to the model as a style reference, 0 to disable
+	UseGitTemplate     bool        `toml:"use_git_template"`     // Append the non-comment lines of git's commit.template to the message
+	Language           string      `toml:"language"`             // Natural language of the message, e.g. "fr" or "French"; types stay English
+}
+
+// CommitRules are optional checks on top of the conventional format. Each
+// one can be toggled on its own.
+type CommitRules struct {
+	NoTrailingPeriod    bool   `toml:"no_trailing_period"`     // Subject must not end with "."
+	SubjectCase         string `toml:"subject_case"`           // "lower" or "upper" first letter of the description; empty to skip
+	SubjectLength       bool   `toml:"subject_length"`         // Reject subjects over subject_max_length instead of warning
+	BlankLineBeforeBody bool   `toml:"blank_line_before_body"` // Require an empty line between subject and body
+}
+
+// TypeRule maps changed paths to a commit type. A pattern ending in "/"
+// matches everything under that directory; anything else is a glob.
+type TypeRule struct {
+	Pattern string `toml:"pattern"`
+	Type    string `toml:"type"`
 }
 
 type SystemConfig struct {
-	MaxRetries     int      `toml:"max_retries"`
-	RetryDelay     int      `toml:"retry_delay"`      // seconds
-	Timeout        int      `toml:"timeout"`          // seconds
-	MaxDiffSize    int      `toml:"max_diff_size"`    // bytes
-	MaxConcurrent  int      `toml:"max_concurrent"`   // max concurrent API calls
-	MaxMessageSize int      `toml:"max_message_size"` // bytes
-	GitHooksPath   string   `toml:"git_hooks_path"`   // Path to git hooks
-	CachePath      string   `toml:"cache_path"`       // Path to cache directory
-	IgnorePaths    []string `toml:"ignore_paths"`     // Paths to ignore in diff
+	MaxRetries          int               `toml:"max_retries"`
+	MaxTotalRetries     int               `toml:"max_total_retries"`     // Attempt budget across all provider calls, 0 for no limit
+	RetryDelay          int               `toml:"retry_delay"`           // seconds
+	MaxRetryDelay       int               `toml:"max_retry_delay"`       // seconds, cap for exponential backoff
+	GenerationCacheTTL  int               `toml:"generation_cache_ttl"`  // hours to reuse a reply for an identical prompt, 0 to disable
+	Timeout             int               `toml:"timeout"`               // seconds
+	Proxy               string            `toml:"proxy"`                 // Proxy URL for all requests; HTTP(S)_PROXY and NO_PROXY apply when empty
+	MaxDiffSize         int               `toml:"max_diff_size"`         // bytes
+	MaxConcurrent       int               `toml:"max_concurrent"`        // max concurrent API calls
+	MaxMessageSize      int               `toml:"max_message_size"`      // bytes
+	GitHooksPath        string            `toml:"git_hooks_path"`        // Path to git hooks
+	CachePath           string            `toml:"cache_path"`            // Path to cache directory
+	IgnorePaths         []string          `toml:"ignore_paths"`          // Paths to ignore in diff
+	StatFallback        bool              `toml:"stat_fallback"`         // Use a deterministic message when ignore rules filter out every change
+	HunkContextOnly     bool              `toml:"hunk_context_only"`     // Send only the @@ hunks of each diff
+	LanguageOverrides   map[string]string `toml:"language_overrides"`    // Extension (e.g. ".proto") to language name
+	IncludeLanguages    []string          `toml:"include_languages"`     // Only send diffs of these languages; others are summarized
+	ExcludeLanguages    []string          `toml:"exclude_languages"`     // Summarize diffs of these languages instead of sending them
+	PromptFilterCommand string            `toml:"prompt_filter_command"` // Shell command that gets the prompt on stdin and prints the one to send
 }
 
 type DisplayConfig struct {
@@ -76,6 +164,8 @@ type DisplayConfig struct {
 	Quiet      bool   `toml:"quiet"`      // Minimal output
 	TimeFormat string `toml:"time_format"`
 	DiffFormat string `toml:"diff_format"` // "unified", "minimal", "patience"
+	DiffView   string `toml:"diff_view"`   // "auto", "full", "stat" or "none" in the confirmation
+	Spinner    *bool  `toml:"spinner"`     // Animate on a terminal while waiting for the provider; on unless false
 }
 
 type TemplateConfig struct {
@@ -84,9 +174,17 @@ type TemplateConfig struct {
 }
 
 type OllamaRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float32   `json:"temperature"`
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Options  OllamaOptions `json:"options"`
+	Stream   bool          `json:"stream"` // Always false; the reply is read as a single object
+}
+
+// OllamaOptions are the sampling parameters; Ollama ignores them outside
+// "options".
+type OllamaOptions struct {
+	Temperature float32 `json:"temperature"`
+	NumPredict  int     `json:"num_predict,omitempty"` // Maximum tokens to generate
 }
 
 type Message struct {
@@ -98,12 +196,31 @@ type OllamaResponse struct {
 	Message struct {
 		Content string `json:"content"`
 	} `json:"message"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+	Error           string `json:"error"` // Set instead of Message, e.g. for an unknown model
+}
+
+// TokenUsage is the token count reported by a provider for a generation.
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
 }
 
 type GitInfo struct {
 	Files        []FileChange
 	Branch       string
 	JiraTicket   string
+	JiraSummary  string       // Ticket title fetched from JIRA, if configured
+	IssueRefs    []string     // Issue references such as "#123" from the branch name
+	IgnoredFiles []FileChange // Staged files excluded from the prompt by ignore rules
+	Context      string       // Extra hints from the author via --context
+	Unpushed     []string     // Subjects of unpushed commits folded in by --since-last-push
+	Breaking     []string     // Likely breaking changes found in the diff
+	History      []string     // Recent commit subjects, newest first, when commit.history_context is set
+	GitTemplate  string       // Non-comment scaffold of git's commit.template, when commit.use_git_template is set
+	Rejected     []string     // Messages the user turned down by regenerating
+	Trailers     []string     // Extra "Key: value" trailers from --trailer
 	LastCommit   string
 	TotalChanges struct {
 		Additions int
@@ -113,27 +230,86 @@ type GitInfo struct {
 
 type FileChange struct {
 	Path     string
+	OldPath  string // Source path for renames and copies
 	Status   string // Added, Modified, Deleted, Renamed
 	Addition int    // Lines added
 	Deletion int    // Lines deleted
 	IsBinary bool
 	Diff     string
 	Language string // Detected programming language
+	OldMode  string // File mode before a mode change, e.g. "100644"
+	NewMode  string // File mode after a mode change
 }
 
 var (
-	configFile string
-	config     Config
-	debug      *color.Color
-	info       *color.Color
-	warn       *color.Color
-	error_     *color.Color
-	cache      *CommitCache
+	configFile  string
+	config      Config
+	debug       *color.Color
+	info        *color.Color
+	warn        *color.Color
+	error_      *color.Color
+	cache       *CommitCache
+	generations *GenerationCache
+	ledger      *UsageLedger
+	jiraRegex   *regexp.Regexp
+
+	// sessionUsage accumulates token usage across all provider calls in this run
+	sessionUsage TokenUsage
+	// providerCalls counts provider attempts in this run for max_total_retries
+	providerCalls int
+	// promptHash is the SHA-256 of the last prompt sent, recorded in git notes
+	promptHash string
+	// diffBase is the revision staged changes are diffed against, set by
+	// --since-last-push; empty means HEAD
+	diffBase string
+	// diffTarget replaces the index as the new side of the diff, so
+	// `zing suggest` can describe an existing commit against diffBase
+	diffTarget string
+	// configLoadErr holds a config parse error tolerated so `zing config`
+	// subcommands can still repair the file
+	configLoadErr error
+	// jsonMode is set by --output json to keep stdout machine-readable
+	jsonMode bool
+	// noColorFlag is set by --no-color and, like NO_COLOR, beats color_mode
+	noColorFlag bool
+	// explainMode is set by --explain to ask the model for a rationale that
+	// is printed to stderr and never committed
+	explainMode bool
 )
 
+const defaultJiraPattern = `[A-Z]+-\d+`
+
+const defaultTemplate = "{{.Type}}{{if .Scope}}({{.Scope}}){{end}}: {{.Description}}"
+
+// defaultPromptTemplate holds the rules asking the model for a message in
+// the configured style. It is rendered with PromptTemplateData.
+const defaultPromptTemplate = `
+Please generate a commit message following these rules:
+{{if eq .Config.Commit.Style "conventional"}}
+- Use conventional commit format: <type>(<scope>): <description>
+- Types should be one of: {{join .Config.Commit.ScopePrefix ", "}}
+- Keep the description concise and clear
+- Use imperative mood ("add" not "added")
+{{- if gt .Config.Commit.SubjectMaxLength 0}}
+- Keep the whole first line under {{.Config.Commit.SubjectMaxLength}} characters
+{{- end}}
+{{- if .Config.Commit.IncludeBreaking}}
+- If there are breaking changes, include a BREAKING CHANGE section
+{{- end}}
+{{- else if eq .Config.Commit.Style "detailed"}}
+- Start with a clear summary line{{if gt .Config.Commit.SubjectMaxLength 0}} under {{.Config.Commit.SubjectMaxLength}} characters{{end}}
+- Add a detailed body explaining the changes
+- Include technical details where relevant
+- Mention any potential side effects
+{{- end}}`
+
+var issueRefRegex = regexp.MustCompile(`(?i)(?:#|\bgh-|\bgl-)(\d+)`)
+
 type CommitCache struct {
-	Path    string
-	Records map[string]CommitRecord
+	Path      string
+	Records   map[string]CommitRecord
+	ReadOnly  bool // Skip writes, e.g. with --no-cache-write or a read-only filesystem
+	NoRecords bool // Keep messages out of the history, for commands that never commit
 }
 
 type CommitRecord struct {
@@ -141,23 +317,30 @@ type CommitRecord struct {
 	Hash      string    `json:"hash"`
 	Timestamp time.Time `json:"timestamp"`
 	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"` // Why an unsuccessful record was not committed, e.g. reasonCancelled
+
+	// Generation details, missing from records written by older versions
+	Provider         string `json:"provider,omitempty"`
+	Model            string `json:"model,omitempty"`
+	DurationMs       int64  `json:"duration_ms,omitempty"`
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
 }
 
 func init() {
-	// Initialize colored output with respect to config and terminal capabilities
-	if !isatty.IsTerminal(os.Stdout.Fd()) {
-		color.NoColor = true
-	}
-
 	debug = color.New(color.FgCyan)
 	info = color.New(color.FgGreen)
 	warn = color.New(color.FgYellow)
 	error_ = color.New(color.FgRed)
+}
 
+// setup resolves the config and cache locations, loads the caches and then
+// the config. It runs from the root command's PersistentPreRunE so failures
+// are reported through cobra instead of exiting before any command runs.
+func setup() error {
 	home, err := os.UserHomeDir()
 	if err != nil {
-		error_.Fprintf(os.Stderr, "Error getting home directory: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("error getting home directory: %w", err)
 	}
 
 	// Set default config file location based on OS
@@ -167,783 +350,5723 @@ func init() {
 	case "windows":
 		configFile = filepath.Join(os.Getenv("APPDATA"), "zing", "config.toml")
 	default:
-		error_.Fprintf(os.Stderr, "Unsupported operating system: %s\n", runtime.GOOS)
-		os.Exit(1)
+		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 
 	// Initialize directories
-	for _, dir := range []string{
-		filepath.Dir(configFile),
-		filepath.Join(home, ".cache", "zing"),
-	} {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			error_.Fprintf(os.Stderr, "Error creating directory %s: %v\n", dir, err)
-			os.Exit(1)
-		}
+	if err := os.MkdirAll(filepath.Dir(configFile), 0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", filepath.Dir(configFile), err)
 	}
 
-	// Initialize cache
+	// Initialize cache, treating an uncreatable cache directory as read-only
+	cacheDir := filepath.Join(home, ".cache", "zing")
 	cache = &CommitCache{
-		Path:    filepath.Join(home, ".cache", "zing", "commits.json"),
+		Path:    filepath.Join(cacheDir, "commits.json"),
 		Records: make(map[string]CommitRecord),
 	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		cache.ReadOnly = true
+	}
 	if err := cache.Load(); err != nil {
 		warn.Printf("Could not load commit cache: %v\n", err)
 	}
+	generations = &GenerationCache{
+		Path:    filepath.Join(cacheDir, "generations.json"),
+		Entries: make(map[string]GenerationEntry),
+	}
+	if err := generations.Load(); err != nil {
+		warn.Printf("Could not load generation cache: %v\n", err)
+	}
+	ledger = &UsageLedger{
+		Path:   filepath.Join(cacheDir, "usage.json"),
+		Months: make(map[string]UsageTotal),
+	}
+	if err := ledger.Load(); err != nil {
+		warn.Printf("Could not load usage ledger: %v\n", err)
+	}
 
 	// Load or create default config
 	if err := loadConfig(); err != nil {
-		error_.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-		os.Exit(1)
-	}
-
-	// Apply color mode setting
-	switch config.Display.ColorMode {
-	case "always":
-		color.NoColor = false
-	case "never":
-		color.NoColor = true
+		return fmt.Errorf("%w %s: %v", errInvalidConfig, configFile, err)
 	}
+	applyConfig()
+	return nil
 }
 
-func (c *CommitCache) Load() error {
-	data, err := os.ReadFile(c.Path)
-	if os.IsNotExist(err) {
-		return nil
-	}
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, &c.Records)
-}
+var errInvalidConfig = errors.New("invalid config file")
 
-func (c *CommitCache) Save() error {
-	data, err := json.MarshalIndent(c.Records, "", "  ")
+// validateConfigFile decodes path strictly and checks value ranges, returning
+// a description of each problem found.
+func validateConfigFile(path string) []string {
+	var c Config
+	meta, err := toml.DecodeFile(path, &c)
 	if err != nil {
-		return err
+		return []string{err.Error()}
 	}
-	return os.WriteFile(c.Path, data, 0644)
-}
 
-func (c *CommitCache) Add(message string, hash string, success bool) {
-	c.Records[hash] = CommitRecord{
-		Message:   message,
-		Hash:      hash,
-		Timestamp: time.Now(),
-		Success:   success,
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
 	}
-	c.Save()
-}
-
-func loadConfig() error {
-	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		defaultConfig := Config{
-			AI: AIConfig{
-				Provider:    "ollama",
-				Model:       "llama2",
-				MaxTokens:   500,
-				Temperature: 0.7,
-				Ollama: struct {
-					URL string `toml:"url"`
-				}{
-					URL: "http://localhost:11434/api/chat",
-				},
-			},
-			Commit: CommitConfig{
-				Style:              "conventional",
-				IncludeScope:       true,
-				IncludeBreaking:    true,
-				MaxLength:          72,
-				ScopePrefix:        []string{"feat", "fix", "docs", "style", "refactor", "test", "chore"},
-				JiraIntegration:    true,
-				SignCommits:        false,
-				EmojisEnabled:      false,
-				VerifyConventional: true,
-			},
-			System: SystemConfig{
-				MaxRetries:     3,
-				RetryDelay:     2,
-				Timeout:        30,
-				MaxDiffSize:    1024 * 1024,
-				MaxConcurrent:  4,
-				MaxMessageSize: 4096,
-				GitHooksPath:   ".git/hooks",
-				CachePath:      filepath.Join(os.TempDir(), "zing"),
-				IgnorePaths:    []string{".env", "*.lock", "node_modules/"},
-			},
-			Display: DisplayConfig{
-				Debug:      false,
-				ColorMode:  "auto",
-				ShowDiff:   true,
-				Quiet:      false,
-				TimeFormat: "2006-01-02 15:04:05",
-				DiffFormat: "unified",
-			},
-			Template: TemplateConfig{
-				CustomTemplates: map[string]string{
-					"default": "{{.Type}}{{if .Scope}}({{.Scope}}){{end}}: {{.Description}}",
-					"detailed": `{{.Type}}{{if .Scope}}({{.Scope}}){{end}}: {{.Description}}
-
-{{.Body}}
-
-{{if .Breaking}}BREAKING CHANGE: {{.Breaking}}{{end}}
-{{if .Closes}}Closes: {{.Closes}}{{end}}`,
-				},
-				ActiveTemplate: "default",
-			},
-		}
-
-		file, err := os.Create(configFile)
-		if err != nil {
-			return fmt.Errorf("error creating config file: %w", err)
+	// An empty value is always accepted and falls back to the default
+	oneOf := func(key, value string, allowed ...string) {
+		if value == "" {
+			return
 		}
-		defer file.Close()
-
-		encoder := toml.NewEncoder(file)
-		if err := encoder.Encode(defaultConfig); err != nil {
-			return fmt.Errorf("error writing default config: %w", err)
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
 		}
-
-		config = defaultConfig
-		return nil
+		add("%s: %q is not one of %s", key, value, strings.Join(allowed, ", "))
 	}
 
-	_, err := toml.DecodeFile(configFile, &config)
-	return err
-}
-
-func detectLanguage(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".go":
-		return "Go"
-	case ".js", ".jsx":
-		return "JavaScript"
-	case ".ts", ".tsx":
-		return "TypeScript"
-	case ".py":
-		return "Python"
-	case ".rb":
-		return "Ruby"
-	case ".java":
-		return "Java"
-	case ".php":
-		return "PHP"
-	case ".rs":
-		return "Rust"
-	case ".c":
-		return "C"
-	case ".cpp":
-		return "C++"
-	case ".cs":
-		return "C#"
-	case ".html":
-		return "HTML"
-	case ".css":
-		return "CSS"
-	case ".md":
-		return "Markdown"
-	default:
-		return "Unknown"
+	for _, key := range meta.Undecoded() {
+		add("unknown key %s", key.String())
 	}
-}
-
-func getGitInfo() (*GitInfo, error) {
-	gitInfo := &GitInfo{}
 
-	// Get current branch
-	branchCmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	branchOutput, err := branchCmd.Output()
-	if err == nil {
-		gitInfo.Branch = strings.TrimSpace(string(branchOutput))
-		// Extract JIRA ticket if enabled
-		if config.Commit.JiraIntegration {
-			re := regexp.MustCompile(`[A-Z]+-\d+`)
-			if match := re.FindString(gitInfo.Branch); match != "" {
-				gitInfo.JiraTicket = match
+	if c.Version > configVersion {
+		add("version: %d is newer than the supported %d", c.Version, configVersion)
+	}
+	if err := validateProvider(c.AI.Provider); err != nil {
+		add("ai.provider: %v", err)
+	}
+	if strings.TrimSpace(c.AI.Model) == "" {
+		add("ai.model: must not be empty")
+	}
+	if c.AI.Temperature < 0 || c.AI.Temperature > 2 {
+		add("ai.temperature: %g is outside 0-2", c.AI.Temperature)
+	}
+	if c.AI.MaxTokens < 0 {
+		add("ai.max_tokens: must not be negative")
+	}
+	profiles := make(map[string]bool)
+	for i, profile := range c.AI.Profiles {
+		switch {
+		case profile.Name == "":
+			add("ai.profiles[%d]: name must not be empty", i)
+		case profiles[profile.Name]:
+			add("ai.profiles[%d]: duplicate name %q", i, profile.Name)
+		}
+		profiles[profile.Name] = true
+		if profile.Provider != "" {
+			if err := validateProvider(profile.Provider); err != nil {
+				add("ai.profiles[%d].provider: %v", i, err)
 			}
 		}
+		if t := profile.Temperature; t != nil && (*t < 0 || *t > 2) {
+			add("ai.profiles[%d].temperature: %g is outside 0-2", i, *t)
+		}
 	}
-
-	// Get last commit hash
-	hashCmd := exec.Command("git", "rev-parse", "HEAD")
-	hashOutput, err := hashCmd.Output()
-	if err == nil {
-		gitInfo.LastCommit = strings.TrimSpace(string(hashOutput))
+	if c.AI.DefaultProfile != "" && !profiles[c.AI.DefaultProfile] {
+		add("ai.default_profile: no profile named %q", c.AI.DefaultProfile)
 	}
-
-	// Get staged files
-	cmd := exec.Command("git", "diff", "--cached", "--name-status")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("error getting staged files: %w", err)
+	if c.Commit.HistoryContext < 0 {
+		add("commit.history_context: must not be negative")
+	}
+	if c.AI.MaxPromptTokens < 0 {
+		add("ai.max_prompt_tokens: must not be negative")
 	}
 
-	files := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, file := range files {
-		if file == "" {
+	oneOf("commit.style", c.Commit.Style, "conventional", "detailed", "custom")
+	oneOf("commit.emoji_style", c.Commit.EmojiStyle, "conventional", "gitmoji")
+	oneOf("commit.issue_tracker", c.Commit.IssueTracker, "jira", "github", "gitlab")
+	oneOf("commit.type_from_branch", c.Commit.TypeFromBranch, "suggest", "enforce")
+	oneOf("commit.sign_format", c.Commit.SignFormat, "gpg", "ssh")
+	oneOf("commit.rules.subject_case", c.Commit.Rules.SubjectCase, "lower", "upper")
+	if c.Commit.MaxLength < 0 || c.Commit.SubjectMaxLength < 0 {
+		add("commit.max_length and commit.subject_max_length must not be negative")
+	}
+	if c.Commit.JiraPattern != "" {
+		if _, err := regexp.Compile(c.Commit.JiraPattern); err != nil {
+			add("commit.jira_pattern: %v", err)
+		}
+	}
+	for _, author := range c.Commit.CoAuthors {
+		if !coAuthorRegex.MatchString(strings.TrimSpace(author)) {
+			add("commit.co_authors: %q is not in \"Name <email>\" form", author)
+		}
+	}
+	for _, footer := range c.Commit.Footers {
+		match := footerRegex.FindStringSubmatch(strings.TrimSpace(footer))
+		if match == nil {
+			add("commit.footers: %q is not in \"Key: value\" form", footer)
 			continue
 		}
+		tmpl, err := template.New(match[1]).Parse(match[3])
+		if err == nil {
+			err = tmpl.Execute(io.Discard, CommitTemplateData{})
+		}
+		if err != nil {
+			add("commit.footers: %q: %v", footer, err)
+		}
+	}
 
-		parts := strings.Fields(file)
-		if len(parts) < 2 {
-			continue
+	for key, value := range map[string]int{
+		"system.max_retries":          c.System.MaxRetries,
+		"system.max_total_retries":    c.System.MaxTotalRetries,
+		"system.retry_delay":          c.System.RetryDelay,
+		"system.max_retry_delay":      c.System.MaxRetryDelay,
+		"system.generation_cache_ttl": c.System.GenerationCacheTTL,
+		"system.max_concurrent":       c.System.MaxConcurrent,
+	} {
+		if value < 0 {
+			add("%s: must not be negative", key)
+		}
+	}
+	if c.System.Timeout <= 0 {
+		add("system.timeout: must be positive")
+	}
+	if c.System.Proxy != "" {
+		if proxyURL, err := url.Parse(c.System.Proxy); err != nil || proxyURL.Host == "" {
+			add("system.proxy: %q is not a valid URL", c.System.Proxy)
 		}
+	}
 
-		status := parts[0]
-		path := parts[1]
+	oneOf("display.color_mode", c.Display.ColorMode, "auto", "always", "never")
+	oneOf("display.diff_format", c.Display.DiffFormat, "unified", "minimal", "patience")
+	oneOf("display.diff_view", c.Display.DiffView, "auto", "full", "stat", "none")
 
-		// Check if path should be ignored
-		ignored := false
-		for _, pattern := range config.System.IgnorePaths {
-			if matched, _ := filepath.Match(pattern, path); matched {
-				ignored = true
-				break
-			}
+	if c.Template.ActiveTemplate != "" {
+		if _, ok := c.Template.CustomTemplates[c.Template.ActiveTemplate]; !ok {
+			add("template.active_template: %q is not defined in template.custom_templates", c.Template.ActiveTemplate)
 		}
-		if ignored {
-			continue
+	}
+	for name, text := range c.Template.CustomTemplates {
+		if _, err := template.New(name).Parse(text); err != nil {
+			add("template.custom_templates.%s: %v", name, err)
 		}
-
-		// Get file diff
-		diff, err := getFileDiff(path)
-		if err != nil {
-			warn.Printf("Warning: Could not get diff for %s: %v\n", path, err)
-			continue
+	}
+	if c.AI.PromptTemplate != "" {
+		// A trial run catches unknown fields, which only fail on execution
+		tmpl, err := parsePromptTemplate(c.AI.PromptTemplate)
+		if err == nil {
+			err = tmpl.Execute(io.Discard, PromptTemplateData{Git: &GitInfo{}, Config: &c})
 		}
-
-		// Check if file is binary
-		cmd = exec.Command("git", "diff", "--cached", "--numstat", path)
-		stats, err := cmd.Output()
 		if err != nil {
-			warn.Printf("Warning: Could not get stats for %s: %v\n", path, err)
-			continue
+			add("ai.prompt_template: %v", err)
 		}
+	}
 
-		statsFields := strings.Fields(string(stats))
-		isBinary := len(statsFields) >= 2 && statsFields[0] == "-" && statsFields[1] == "-"
+	sort.Strings(problems)
+	return problems
+}
 
-		fileChange := FileChange{
-			Path:     path,
-			Status:   parseGitStatus(status),
-			IsBinary: isBinary,
-			Diff:     diff,
-			Language: detectLanguage(path),
-		}
+// applyConfig derives runtime state from a freshly loaded config.
+func applyConfig() {
+	jiraRegex = compileJiraPattern(config.Commit.JiraPattern)
+	config.Commit.CoAuthors = validCoAuthors(config.Commit.CoAuthors)
 
-		if !isBinary && len(statsFields) >= 2 {
-			fileChange.Addition, _ = strconv.Atoi(statsFields[0])
-			fileChange.Deletion, _ = strconv.Atoi(statsFields[1])
-			gitInfo.TotalChanges.Additions += fileChange.Addition
-			gitInfo.TotalChanges.Deletions += fileChange.Deletion
-		}
+	applyColor()
+}
 
-		gitInfo.Files = append(gitInfo.Files, fileChange)
+// colorEnabled decides whether to print color: --no-color wins, then
+// NO_COLOR (https://no-color.org), then display.color_mode. An "auto" or
+// empty mode colors only a terminal.
+func colorEnabled(mode string, terminal, noColorEnv, noColorFlag bool) bool {
+	switch {
+	case noColorFlag, noColorEnv:
+		return false
+	case mode == "always":
+		return true
+	case mode == "never":
+		return false
 	}
-
-	return gitInfo, nil
+	return terminal
 }
 
-func parseGitStatus(status string) string {
-	switch status[0] {
-	case 'A':
-		return "Added"
-	case 'M':
-		return "Modified"
-	case 'D':
-		return "Deleted"
-	case 'R':
-		return "Renamed"
-	case 'C':
-		return "Copied"
-	case 'U':
-		return "Unmerged"
-	default:
-		return "Unknown"
+// applyColor sets up colored output from the flags, environment, config and
+// the output stream. It runs once flags are parsed, so setup's own warnings
+// are right, and again whenever the config is (re)loaded.
+func applyColor() {
+	// With --output json, everything for humans goes to stderr
+	stream := os.Stdout
+	if jsonMode {
+		stream = os.Stderr
 	}
+	terminal := (isatty.IsTerminal(stream.Fd()) || isatty.IsCygwinTerminal(stream.Fd())) && os.Getenv("TERM") != "dumb"
+	color.NoColor = !colorEnabled(config.Display.ColorMode, terminal, os.Getenv("NO_COLOR") != "", noColorFlag)
 }
 
-func getFileDiff(file string) (string, error) {
-	var args []string
-	switch config.Display.DiffFormat {
-	case "minimal":
-		args = []string{"diff", "--cached", "--minimal"}
-	case "patience":
-		args = []string{"diff", "--cached", "--patience"}
-	default:
-		args = []string{"diff", "--cached"}
+func (c *CommitCache) Load() error {
+	data, err := os.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	args = append(args, file)
-
-	cmd := exec.Command("git", args...)
-	output, err := cmd.Output()
 	if err != nil {
-		return "", fmt.Errorf("error getting file diff: %w", err)
+		return err
 	}
-	return string(output), nil
+	return json.Unmarshal(data, &c.Records)
 }
 
-type CommitTemplateData struct {
-	Type        string
-	Scope       string
-	Description string
-	Body        string
-	Breaking    string
-	Closes      string
-	JiraTicket  string
-	CoAuthors   []string
+func (c *CommitCache) Save() error {
+	data, err := json.MarshalIndent(c.Records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.Path, data, 0644)
 }
 
-func generateCommitMessage(gitInfo *GitInfo) (string, error) {
-	var prompt strings.Builder
-
-	prompt.WriteString("Generate a commit message for the following changes:\n\n")
-	prompt.WriteString(fmt.Sprintf("Total Changes: +%d/-%d lines\n",
-		gitInfo.TotalChanges.Additions,
-		gitInfo.TotalChanges.Deletions))
-
-	// Add contextual information
-	prompt.WriteString(fmt.Sprintf("\nBranch: %s\n", gitInfo.Branch))
-	if gitInfo.JiraTicket != "" {
-		prompt.WriteString(fmt.Sprintf("JIRA Ticket: %s\n", gitInfo.JiraTicket))
-	}
+// Reasons a generated message was not committed
+const (
+	reasonCancelled    = "cancelled"     // The user quit at the confirmation prompt
+	reasonCommitFailed = "commit-failed" // git commit failed, e.g. on a hook
+	reasonVerifyFailed = "verify-failed" // The message failed commit.verify
+)
 
-	// Add language-specific context
-	languageStats := make(map[string]int)
-	for _, file := range gitInfo.Files {
-		languageStats[file.Language]++
+// Add stores record under its hash, stamped with the current time. Records
+// that were never committed have no hash and get a synthetic id from their
+// reason and time instead.
+func (c *CommitCache) Add(record CommitRecord) {
+	if c.ReadOnly || c.NoRecords {
+		return
 	}
-	prompt.WriteString("\nLanguages affected:\n")
-	for lang, count := range languageStats {
-		prompt.WriteString(fmt.Sprintf("- %s (%d files)\n", lang, count))
+	record.Timestamp = time.Now()
+	key := record.Hash
+	if key == "" {
+		key = record.Reason + "-" + record.Timestamp.Format(time.RFC3339Nano)
 	}
-
-	// Add file changes
-	prompt.WriteString("\nChanged files:\n")
-	for _, file := range gitInfo.Files {
-		prompt.WriteString(fmt.Sprintf("\n=== %s (%s) ===\n", file.Path, file.Status))
-		if !file.IsBinary {
-			prompt.WriteString(fmt.Sprintf("Changes: +%d/-%d lines\n", file.Addition, file.Deletion))
-			prompt.WriteString(file.Diff)
-		} else {
-			prompt.WriteString("[Binary file]\n")
+	c.Records[key] = record
+	if err := c.Save(); err != nil {
+		if os.IsPermission(err) || errors.Is(err, syscall.EROFS) {
+			c.ReadOnly = true
+			return
 		}
+		warn.Printf("Could not save commit cache: %v\n", err)
 	}
+}
 
-	// Add style instructions
-	prompt.WriteString("\nPlease generate a commit message following these rules:\n")
-	if config.Commit.Style == "conventional" {
-		prompt.WriteString(`
-1. Use conventional commit format: <type>(<scope>): <description>
-2. Types should be one of: ` + strings.Join(config.Commit.ScopePrefix, ", ") + `
-3. Keep the description concise and clear
-4. Use imperative mood ("add" not "added")`)
-		if config.Commit.IncludeBreaking {
-			prompt.WriteString("\n5. If there are breaking changes, include a BREAKING CHANGE section")
-		}
-	} else if config.Commit.Style == "detailed" {
-		prompt.WriteString(`
-1. Start with a clear summary line
-2. Add a detailed body explaining the changes
-3. Include technical details where relevant
-4. Mention any potential side effects`)
-	}
-
-	debugLog("Generated prompt:\n%s", prompt.String())
-
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
-	defer cancel()
-
-	var message string
-	var err error
-
-	s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
-	s.Suffix = " Generating commit message..."
-	s.Start()
-	defer s.Stop()
-
-	// Try generating message with retries
-	for attempt := 1; attempt <= config.System.MaxRetries; attempt++ {
-		switch config.AI.Provider {
-		case "openai":
-			message, err = generateWithOpenAI(ctx, prompt.String())
-		case "ollama":
-			message, err = generateWithOllama(ctx, prompt.String())
-		default:
-			return "", fmt.Errorf("unsupported provider: %s", config.AI.Provider)
-		}
-
-		if err == nil {
-			break
-		}
+// GenerationCache stores raw provider replies keyed by a hash of the prompt,
+// provider and model, so re-running zing on an identical diff is free.
+type GenerationCache struct {
+	Path    string
+	Entries map[string]GenerationEntry
+	Bypass  bool // Set by --no-cache: skip lookups but still store fresh replies
+	NoStore bool // Set by zing suggest without --cache: use cached replies but store none
+}
 
-		if attempt == config.System.MaxRetries {
-			return "", fmt.Errorf("failed after %d attempts: %w", config.System.MaxRetries, err)
-		}
+type GenerationEntry struct {
+	Reply     string    `json:"reply"`
+	Timestamp time.Time `json:"timestamp"`
+}
 
-		warn.Printf("Attempt %d failed: %v. Retrying in %d seconds...\n",
-			attempt, err, config.System.RetryDelay)
-		time.Sleep(time.Duration(config.System.RetryDelay) * time.Second)
+func (g *GenerationCache) Load() error {
+	data, err := os.ReadFile(g.Path)
+	if os.IsNotExist(err) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &g.Entries)
+}
 
-	// Post-process the message
-	message = postProcessCommitMessage(message, gitInfo)
-
-	// Verify conventional commit format if enabled
-	if config.Commit.VerifyConventional && config.Commit.Style == "conventional" {
-		if err := verifyConventionalCommit(message); err != nil {
-			return "", fmt.Errorf("generated message does not follow conventional commit format: %w", err)
-		}
+func (g *GenerationCache) Save() error {
+	data, err := json.MarshalIndent(g.Entries, "", "  ")
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(g.Path, data, 0644)
+}
 
-	return message, nil
+// ttl is system.generation_cache_ttl as a duration; zero disables the cache.
+func (g *GenerationCache) ttl() time.Duration {
+	return time.Duration(config.System.GenerationCacheTTL) * time.Hour
 }
 
-func postProcessCommitMessage(message string, gitInfo *GitInfo) string {
-	// Add JIRA ticket if enabled and not already present
-	if config.Commit.JiraIntegration && gitInfo.JiraTicket != "" {
-		if !strings.Contains(message, gitInfo.JiraTicket) {
-			message = fmt.Sprintf("%s [%s]", message, gitInfo.JiraTicket)
-		}
+// Get returns the cached reply for key unless it has expired.
+func (g *GenerationCache) Get(key string) (string, bool) {
+	if g.Bypass || g.ttl() <= 0 {
+		return "", false
+	}
+	entry, ok := g.Entries[key]
+	if !ok || time.Since(entry.Timestamp) > g.ttl() {
+		return "", false
 	}
+	return entry.Reply, true
+}
 
-	// Add co-authors if configured
-	if len(config.Commit.CoAuthors) > 0 {
-		message += "\n\n"
-		for _, author := range config.Commit.CoAuthors {
-			message += fmt.Sprintf("Co-authored-by: %s\n", author)
+// Add stores a reply and drops expired entries. Like the usage ledger,
+// writes are skipped whenever the commit cache is read-only.
+func (g *GenerationCache) Add(key, reply string) {
+	if cache.ReadOnly || g.NoStore || g.ttl() <= 0 {
+		return
+	}
+	for k, entry := range g.Entries {
+		if time.Since(entry.Timestamp) > g.ttl() {
+			delete(g.Entries, k)
 		}
 	}
-
-	// Add emojis if enabled
-	if config.Commit.EmojisEnabled {
-		message = addCommitEmojis(message)
+	g.Entries[key] = GenerationEntry{Reply: reply, Timestamp: time.Now()}
+	if err := g.Save(); err != nil && !os.IsPermission(err) && !errors.Is(err, syscall.EROFS) {
+		warn.Printf("Could not save generation cache: %v\n", err)
 	}
+}
 
-	// Ensure message isn't too long
-	if len(message) > config.Commit.MaxLength {
-		lines := strings.Split(message, "\n")
-		lines[0] = lines[0][:config.Commit.MaxLength]
-		message = strings.Join(lines, "\n")
-	}
+// generationCacheKey hashes everything that shapes the provider's reply.
+func generationCacheKey(prompt string) string {
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%g\x00%s",
+		config.AI.Provider, config.AI.Model, config.AI.MaxTokens, config.AI.Temperature, prompt)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
 
-	return message
+// UsageLedger keeps running token and cost totals per calendar month.
+type UsageLedger struct {
+	Path   string
+	Months map[string]UsageTotal // keyed by "2006-01"
 }
 
-func verifyConventionalCommit(message string) error {
-	pattern := `^(?i)(` + strings.Join(config.Commit.ScopePrefix, "|") + `)`
-	if config.Commit.IncludeScope {
-		pattern += `(\([^)]+\))?`
-	}
-	pattern += `: .+`
+type UsageTotal struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
 
-	matched, err := regexp.MatchString(pattern, message)
-	if err != nil {
-		return fmt.Errorf("error matching pattern: %w", err)
+func (l *UsageLedger) Load() error {
+	data, err := os.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	if !matched {
-		return fmt.Errorf("message does not match conventional commit format")
+	if err != nil {
+		return err
 	}
-	return nil
+	return json.Unmarshal(data, &l.Months)
 }
 
-func addCommitEmojis(message string) string {
-	emojiMap := map[string]string{
-		"feat":     "✨",
-		"fix":      "🐛",
-		"docs":     "📚",
-		"style":    "💎",
-		"refactor": "♻️",
-		"test":     "🧪",
-		"chore":    "🔧",
+func (l *UsageLedger) Save() error {
+	data, err := json.MarshalIndent(l.Months, "", "  ")
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(l.Path, data, 0644)
+}
 
-	for typeStr, emoji := range emojiMap {
-		pattern := fmt.Sprintf(`^%s(\([^)]+\))?:`, typeStr)
-		re := regexp.MustCompile(pattern)
-		message = re.ReplaceAllString(message, fmt.Sprintf("%s %s$0", emoji, typeStr))
+// Add records usage against the current month. Writes are skipped whenever
+// the commit cache is read-only.
+func (l *UsageLedger) Add(usage TokenUsage, cost float64) {
+	if cache.ReadOnly {
+		return
 	}
+	month := time.Now().Format("2006-01")
+	total := l.Months[month]
+	total.Requests++
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.Cost += cost
+	l.Months[month] = total
+	if err := l.Save(); err != nil && !os.IsPermission(err) && !errors.Is(err, syscall.EROFS) {
+		warn.Printf("Could not save usage ledger: %v\n", err)
+	}
+}
 
-	return message
+// estimateCost returns the configured price for the given usage, or 0 when
+// no price is set for the active provider.
+func estimateCost(usage TokenUsage) float64 {
+	if config.AI.Provider != "openai" || config.AI.OpenAI.PricePer1k <= 0 {
+		return 0
+	}
+	tokens := usage.PromptTokens + usage.CompletionTokens
+	return float64(tokens) / 1000 * config.AI.OpenAI.PricePer1k
 }
 
-func generateWithOpenAI(ctx context.Context, prompt string) (string, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("OPENAI_API_KEY environment variable not set")
+// formatThousands renders n with comma separators, e.g. 1,240.
+func formatThousands(n int) string {
+	if n < 0 {
+		return "-" + formatThousands(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
 	}
+	return s
+}
 
-	client := openai.NewClient(apiKey)
-	resp, err := client.CreateChatCompletion(
-		ctx,
-		openai.ChatCompletionRequest{
-			Model: config.AI.Model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: prompt,
-				},
+// defaultConfig returns the configuration written on first run and by
+// `zing config reset`.
+func defaultConfig() Config {
+	spinnerOn := true
+	return Config{
+		Version: configVersion,
+		AI: AIConfig{
+			Provider:    "ollama",
+			Model:       "llama2",
+			MaxTokens:   500,
+			Temperature: 0.7,
+			Ollama: struct {
+				URL string `toml:"url"`
+			}{
+				URL: "http://localhost:11434/api/chat",
 			},
-			MaxTokens:   config.AI.MaxTokens,
-			Temperature: config.AI.Temperature,
 		},
-	)
+		Commit: CommitConfig{
+			Style:              "conventional",
+			IncludeScope:       true,
+			IncludeBreaking:    true,
+			MaxLength:          72,
+			SubjectMaxLength:   50,
+			ScopePrefix:        []string{"feat", "fix", "docs", "style", "refactor", "test", "chore"},
+			JiraIntegration:    true,
+			JiraPattern:        defaultJiraPattern,
+			IssueTracker:       "jira",
+			SignCommits:        false,
+			SignFormat:         "gpg",
+			EmojisEnabled:      false,
+			EmojiStyle:         "conventional",
+			VerifyConventional: true,
+			WrapBody:           true,
+			Rules: CommitRules{
+				NoTrailingPeriod:    true,
+				BlankLineBeforeBody: true,
+			},
+		},
+		System: SystemConfig{
+			MaxRetries:         3,
+			RetryDelay:         2,
+			MaxRetryDelay:      30,
+			GenerationCacheTTL: 24,
+			Timeout:            30,
+			MaxDiffSize:        1024 * 1024,
+			MaxConcurrent:      4,
+			MaxMessageSize:     4096,
+			GitHooksPath:       ".git/hooks",
+			CachePath:          filepath.Join(os.TempDir(), "zing"),
+			IgnorePaths:        []string{".env", "*.lock", "node_modules/"},
+		},
+		Display: DisplayConfig{
+			Debug:      false,
+			ColorMode:  "auto",
+			ShowDiff:   true,
+			Quiet:      false,
+			TimeFormat: "2006-01-02 15:04:05",
+			DiffFormat: "unified",
+			DiffView:   "auto",
+			Spinner:    &spinnerOn,
+		},
+		Template: TemplateConfig{
+			CustomTemplates: map[string]string{
+				"default": defaultTemplate,
+				"detailed": `{{.Type}}{{if .Scope}}({{.Scope}}){{end}}: {{.Description}}
 
-	if err != nil {
-		return "", fmt.Errorf("error generating with OpenAI: %w", err)
+{{.Body}}
+
+{{if .Breaking}}BREAKING CHANGE: {{.Breaking}}{{end}}
+{{if .Closes}}Closes: {{.Closes}}{{end}}`,
+			},
+			ActiveTemplate: "default",
+		},
+	}
+}
+
+func loadConfig() error {
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		config = defaultConfig()
+		if err := saveConfig(); err != nil {
+			return fmt.Errorf("error writing default config: %w", err)
+		}
+		return nil
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		return err
+	}
+	switch {
+	case config.Version < configVersion:
+		return migrateConfig()
+	case config.Version > configVersion:
+		warn.Fprintf(os.Stderr, "%s is config version %d, newer than this zing understands (%d); unknown settings are ignored\n",
+			configFile, config.Version, configVersion)
+	}
+	return nil
 }
 
-func generateWithOllama(ctx context.Context, prompt string) (string, error) {
-	reqBody := OllamaRequest{
-		Model: config.AI.Model,
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: prompt,
-			},
+// configVersion is the current config schema version. Bump it and add a
+// step to configMigrations whenever a release needs existing files changed,
+// such as a new setting whose zero value would not match its default.
+const configVersion = 1
+
+// configMigration upgrades a decoded config file to version, returning a
+// line per key it added ("+ key = value") or removed ("- key"). Steps only
+// touch the keys their version changed.
+type configMigration struct {
+	version int
+	migrate func(raw map[string]interface{}) []string
+}
+
+var configMigrations = []configMigration{
+	{
+		// Settings added before versioning whose zero value turns them off
+		version: 1,
+		migrate: func(raw map[string]interface{}) []string {
+			return addMissingKeys(raw, []configDefault{
+				{"commit.subject_max_length", int64(50)},
+				{"commit.wrap_body", true},
+				{"commit.rules.no_trailing_period", true},
+				{"commit.rules.blank_line_before_body", true},
+				{"system.max_retry_delay", int64(30)},
+				{"system.generation_cache_ttl", int64(24)},
+			})
 		},
-		Temperature: config.AI.Temperature,
+	},
+}
+
+// configDefault is a dotted config key and the value a migration gives it.
+type configDefault struct {
+	key   string
+	value interface{}
+}
+
+// addMissingKeys sets each key the file doesn't define, creating tables as
+// needed. Keys the user set, to any value, are left alone.
+func addMissingKeys(raw map[string]interface{}, defaults []configDefault) []string {
+	var added []string
+	for _, d := range defaults {
+		parts := strings.Split(d.key, ".")
+		table := raw
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := table[part].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				table[part] = next
+			}
+			table = next
+		}
+		name := parts[len(parts)-1]
+		if _, ok := table[name]; ok {
+			continue
+		}
+		table[name] = d.value
+		value := d.value
+		if text, ok := value.(string); ok {
+			value = strconv.Quote(text)
+		}
+		added = append(added, fmt.Sprintf("+ %s = %v", d.key, value))
 	}
+	return added
+}
 
-	jsonBody, err := json.Marshal(reqBody)
+// migrateRawConfig applies the migrations newer than from to a decoded
+// config file and stamps it with configVersion.
+func migrateRawConfig(raw map[string]interface{}, from int) []string {
+	var changes []string
+	for _, step := range configMigrations {
+		if step.version > from {
+			changes = append(changes, step.migrate(raw)...)
+		}
+	}
+	raw["version"] = int64(configVersion)
+	return changes
+}
+
+// migrateConfig upgrades a config file older than configVersion. Only the
+// keys a version changed are touched, so defaults are not copied into the
+// file. The old file is kept as a backup and the changes are listed.
+func migrateConfig() error {
+	from := config.Version
+	var raw map[string]interface{}
+	if _, err := toml.DecodeFile(configFile, &raw); err != nil {
+		return err
+	}
+	changes := migrateRawConfig(raw, from)
+
+	var migrated bytes.Buffer
+	if err := toml.NewEncoder(&migrated).Encode(raw); err != nil {
+		return fmt.Errorf("error migrating config: %w", err)
+	}
+	config = Config{}
+	if _, err := toml.Decode(migrated.String(), &config); err != nil {
+		return fmt.Errorf("error migrating config: %w", err)
+	}
+
+	// The upgrade applies for this run even if the file can't be rewritten
+	backup := configFile + ".bak"
+	data, err := os.ReadFile(configFile)
+	if err == nil {
+		err = os.WriteFile(backup, data, 0644)
+	}
+	if err == nil {
+		err = os.WriteFile(configFile, migrated.Bytes(), 0644)
+	}
 	if err != nil {
-		return "", fmt.Errorf("error marshaling request: %w", err)
+		warn.Fprintf(os.Stderr, "Could not upgrade %s to config version %d: %v\n", configFile, configVersion, err)
+		return nil
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", config.AI.Ollama.URL, bytes.NewBuffer(jsonBody))
+	info.Fprintf(os.Stderr, "Upgraded %s from config version %d to %d; the previous file is at %s\n", configFile, from, configVersion, backup)
+	for _, line := range changes {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+	return nil
+}
+
+// compileJiraPattern compiles the configured ticket pattern, falling back to
+// the default when it is empty or invalid.
+func compileJiraPattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		pattern = defaultJiraPattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		warn.Printf("Invalid jira_pattern %q, using default: %v\n", pattern, err)
+		return regexp.MustCompile(defaultJiraPattern)
+	}
+	return re
+}
+
+var coAuthorRegex = regexp.MustCompile(`^[^<>]+ <[^<>@\s]+@[^<>\s]+>$`)
+
+// validCoAuthors keeps the co_authors entries in "Name <email>" form,
+// warning about malformed ones and dropping repeats of the same email.
+func validCoAuthors(authors []string) []string {
+	var valid []string
+	seen := make(map[string]bool)
+	for _, author := range authors {
+		author = strings.TrimSpace(author)
+		if !coAuthorRegex.MatchString(author) {
+			warn.Printf("Skipping co-author %q: expected \"Name <email>\"\n", author)
+			continue
+		}
+		email := strings.ToLower(author[strings.LastIndex(author, "<"):])
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		valid = append(valid, author)
+	}
+	return valid
+}
+
+// extractJiraTicket returns the ticket found in the branch name. If the
+// pattern has a capture group, the first group is used as the ticket.
+func extractJiraTicket(branch string) string {
+	match := jiraRegex.FindStringSubmatch(branch)
+	if match == nil {
+		return ""
+	}
+	if len(match) > 1 && match[1] != "" {
+		return match[1]
+	}
+	return match[0]
+}
+
+// fetchJiraSummary looks up a ticket's title via the JIRA REST API, bounded by
+// system.timeout.
+func fetchJiraSummary(ticket string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
+	defer cancel()
+
+	url := strings.TrimRight(config.Commit.JiraURL, "/") + "/rest/api/2/issue/" + ticket + "?fields=summary"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if token := os.Getenv("JIRA_API_TOKEN"); token != "" {
+		if config.Commit.JiraEmail != "" {
+			req.SetBasicAuth(config.Commit.JiraEmail, token)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
 
-	client := &http.Client{}
+	client := &http.Client{Transport: newTransport()}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error making request to Ollama: %w", err)
+		return "", fmt.Errorf("error making request to JIRA: %w", err)
 	}
 	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("JIRA returned %s", resp.Status)
 	}
 
-	var ollamaResp OllamaResponse
-	if err := json.Unmarshal(body, &ollamaResp); err != nil {
-		return "", fmt.Errorf("error unmarshaling response: %w", err)
+	var issue struct {
+		Fields struct {
+			Summary string `json:"summary"`
+		} `json:"fields"`
 	}
+	if err := json.NewDecoder(resp.Body).Decode(&issue); err != nil {
+		return "", fmt.Errorf("error decoding JIRA response: %w", err)
+	}
+	return strings.TrimSpace(issue.Fields.Summary), nil
+}
 
-	return ollamaResp.Message.Content, nil
+// extractIssueRefs returns every "#123" or "gh-123" style reference in the
+// branch name, normalized to "#123" and deduplicated.
+func extractIssueRefs(branch string) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	for _, match := range issueRefRegex.FindAllStringSubmatch(branch, -1) {
+		ref := "#" + match[1]
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs
 }
 
-func main() {
-	var rootCmd = &cobra.Command{
-		Use:   "zing",
-		Short: "AI-powered commit message generator",
-		Long: `Zing is a smart commit message generator that uses AI to create
-meaningful commit messages based on your staged changes.
+var languageExtensions = map[string]string{
+	".go":      "Go",
+	".js":      "JavaScript",
+	".jsx":     "JavaScript",
+	".mjs":     "JavaScript",
+	".cjs":     "JavaScript",
+	".ts":      "TypeScript",
+	".tsx":     "TypeScript",
+	".py":      "Python",
+	".rb":      "Ruby",
+	".java":    "Java",
+	".kt":      "Kotlin",
+	".kts":     "Kotlin",
+	".scala":   "Scala",
+	".swift":   "Swift",
+	".m":       "Objective-C",
+	".php":     "PHP",
+	".rs":      "Rust",
+	".c":       "C",
+	".h":       "C",
+	".cpp":     "C++",
+	".cc":      "C++",
+	".hpp":     "C++",
+	".cs":      "C#",
+	".fs":      "F#",
+	".dart":    "Dart",
+	".ex":      "Elixir",
+	".exs":     "Elixir",
+	".erl":     "Erlang",
+	".hs":      "Haskell",
+	".clj":     "Clojure",
+	".lua":     "Lua",
+	".pl":      "Perl",
+	".r":       "R",
+	".jl":      "Julia",
+	".zig":     "Zig",
+	".sh":      "Shell",
+	".bash":    "Shell",
+	".zsh":     "Shell",
+	".fish":    "Shell",
+	".ps1":     "PowerShell",
+	".sql":     "SQL",
+	".html":    "HTML",
+	".css":     "CSS",
+	".scss":    "SCSS",
+	".sass":    "Sass",
+	".less":    "Less",
+	".vue":     "Vue",
+	".svelte":  "Svelte",
+	".md":      "Markdown",
+	".rst":     "reStructuredText",
+	".json":    "JSON",
+	".yaml":    "YAML",
+	".yml":     "YAML",
+	".toml":    "TOML",
+	".xml":     "XML",
+	".proto":   "Protocol Buffers",
+	".graphql": "GraphQL",
+	".tf":      "Terraform",
+	".tfvars":  "Terraform",
+	".hcl":     "HCL",
+	".nix":     "Nix",
+	".tar.gz":  "Archive",
+	".tgz":     "Archive",
+	".gz":      "Archive",
+	".zip":     "Archive",
+}
 
-It supports both OpenAI and Ollama as AI providers and can generate
-messages in conventional commits format or detailed style.`,
-		RunE: func(cmd *cobra.Command, args []string) error {
-			// Check if we're in a git repository
-			if _, err := exec.Command("git", "rev-parse", "--git-dir").Output(); err != nil {
-				return fmt.Errorf("not a git repository")
-			}
+var languageFilenames = map[string]string{
+	"dockerfile":  "Dockerfile",
+	"makefile":    "Makefile",
+	"jenkinsfile": "Groovy",
+	"gemfile":     "Ruby",
+	"rakefile":    "Ruby",
+}
 
-			gitInfo, err := getGitInfo()
-			if err != nil {
-				return err
-			}
+var shebangLanguages = map[string]string{
+	"sh":      "Shell",
+	"bash":    "Shell",
+	"zsh":     "Shell",
+	"python":  "Python",
+	"python3": "Python",
+	"node":    "JavaScript",
+	"ruby":    "Ruby",
+	"perl":    "Perl",
+}
 
-			if len(gitInfo.Files) == 0 {
-				return fmt.Errorf("no staged changes found")
-			}
+// detectLanguage names the language of a file from its name, falling back
+// to a shebang for files without an extension. diff and blob locate that
+// first line, see detectShebang.
+func detectLanguage(filename, diff, blob string) string {
+	base := strings.ToLower(filepath.Base(filename))
 
-			if !config.Display.Quiet {
-				info.Printf("Found %d staged files", len(gitInfo.Files))
-				fmt.Println("Changes summary:")
-				for _, file := range gitInfo.Files {
-					if file.IsBinary {
-						fmt.Printf("  %s: %s (binary file)\n", file.Status, file.Path)
-					} else {
-						fmt.Printf("  %s: %s (+%d/-%d)\n", file.Status, file.Path, file.Addition, file.Deletion)
-					}
-				}
-			}
+	// Try the longest compound extension first, so "backup.tar.gz"
+	// matches ".tar.gz" before ".gz". Leading dots of dotfiles are skipped.
+	name := strings.TrimLeft(base, ".")
+	for i := strings.Index(name, "."); i != -1; {
+		if lang := lookupExtension(name[i:]); lang != "" {
+			return lang
+		}
+		next := strings.Index(name[i+1:], ".")
+		if next == -1 {
+			break
+		}
+		i += next + 1
+	}
 
-			message, err := generateCommitMessage(gitInfo)
-			if err != nil {
-				return fmt.Errorf("error generating commit message: %w", err)
-			}
+	if lang, ok := languageFilenames[base]; ok {
+		return lang
+	}
+	if !strings.Contains(name, ".") {
+		if lang := detectShebang(diff, blob); lang != "" {
+			return lang
+		}
+	}
+	return "Unknown"
+}
 
-			autoConfirm, _ := cmd.Flags().GetBool("yes")
-			if !autoConfirm {
-				fmt.Printf("\nGenerated commit message:\n%s\n\n", message)
-				if config.Display.ShowDiff {
-					fmt.Println("Changes to be committed:")
-					diffCmd := exec.Command("git", "diff", "--cached", "--color")
-					diffCmd.Stdout = os.Stdout
-					diffCmd.Run()
-				}
-				fmt.Print("Proceed with commit? [Y/n] ")
-				var response string
-				fmt.Scanln(&response)
-				response = strings.ToLower(strings.TrimSpace(response))
-				if response == "n" || response == "no" {
-					fmt.Println("commit cancelled by user")
-					return nil
-				}
-			}
+// lookupExtension checks the user overrides, which may be written with or
+// without the leading dot, before the built-in table.
+func lookupExtension(ext string) string {
+	if lang, ok := config.System.LanguageOverrides[ext]; ok {
+		return lang
+	}
+	if lang, ok := config.System.LanguageOverrides[strings.TrimPrefix(ext, ".")]; ok {
+		return lang
+	}
+	return languageExtensions[ext]
+}
 
-			// Prepare commit command
-			args = []string{"commit", "-m", message}
-			if config.Commit.SignCommits {
-				args = append(args, "-S")
-			}
+// detectShebang maps the interpreter on a file's first line to a language.
+// The line comes from the file's own diff when a hunk starts there, and is
+// otherwise read from blob, the object holding the content being described.
+// blob is empty when there is no repository to read, as with --stdin.
+func detectShebang(diff, blob string) string {
+	line, ok := firstNewLine(diff)
+	if !ok && blob != "" {
+		line = firstBlobLine(blob)
+	}
+	if !strings.HasPrefix(line, "#!") {
+		return ""
+	}
 
-			// Execute git commit
-			commitCmd := exec.Command("git", args...)
-			commitCmd.Stdout = os.Stdout
-			commitCmd.Stderr = os.Stderr
-			if err := commitCmd.Run(); err != nil {
-				return fmt.Errorf("error executing git commit: %w", err)
-			}
+	// Handle both "#!/bin/bash" and "#!/usr/bin/env python3"
+	fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+	return shebangLanguages[interpreter]
+}
 
-			// Get the commit hash
-			hashCmd := exec.Command("git", "rev-parse", "HEAD")
-			hashOutput, err := hashCmd.Output()
-			if err == nil {
-				hash := strings.TrimSpace(string(hashOutput))
-				cache.Add(message, hash, true)
-			}
+var firstLineHunkRegex = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+1(?:,\d+)? @@`)
 
-			if !config.Display.Quiet {
-				info.Println("Successfully committed changes!")
+// firstNewLine returns the first line of the new side of a diff, if a hunk
+// covers it.
+func firstNewLine(diff string) (string, bool) {
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		if !firstLineHunkRegex.MatchString(line) {
+			continue
+		}
+		for _, line := range lines[i+1:] {
+			switch {
+			case strings.HasPrefix(line, "+"), strings.HasPrefix(line, " "):
+				return line[1:], true
+			case strings.HasPrefix(line, "-"), strings.HasPrefix(line, "\\"):
+				// Old content and "\ No newline at end of file"
+			default:
+				return "", false
 			}
-			return nil
-		},
+		}
+		return "", false
 	}
+	return "", false
+}
 
-	// Add flags
-	rootCmd.Flags().BoolP("yes", "y", false, "Automatically confirm and proceed with commit")
-	rootCmd.Flags().StringP("template", "t", "", "Use specific commit message template")
-	rootCmd.Flags().BoolP("version", "v", false, "Show version information")
-
-	// Config command
-	var configCmd = &cobra.Command{
-		Use:   "config",
-		Short: "Manage configuration",
-		Long:  "View or modify Zing configuration settings",
+// firstBlobLine reads the first line of a git object such as ":path".
+func firstBlobLine(blob string) string {
+	cmd := exec.Command("git", "show", blob)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return ""
 	}
-
-	// Show config
-	var showConfigCmd = &cobra.Command{
-		Use:   "show",
-		Short: "Show current configuration",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("Config file location: %s\n\n", configFile)
-			fmt.Printf("Current configuration:\n")
-			encoder := toml.NewEncoder(os.Stdout)
-			encoder.Encode(config)
-		},
+	if err := cmd.Start(); err != nil {
+		return ""
 	}
+	defer cmd.Wait()
+	defer stdout.Close()
 
-	// Edit config
-	var editConfigCmd = &cobra.Command{
-		Use:   "edit",
-		Short: "Open configuration file in default editor",
-		Run: func(cmd *cobra.Command, args []string) {
-			editor := os.Getenv("EDITOR")
-			if editor == "" {
-				editor = "vim"
-			}
+	buf := make([]byte, 128)
+	n, _ := io.ReadFull(stdout, buf)
+	line, _, _ := strings.Cut(string(buf[:n]), "\n")
+	return line
+}
 
-			editCmd := exec.Command(editor, configFile)
-			editCmd.Stdin = os.Stdin
-			editCmd.Stdout = os.Stdout
-			editCmd.Stderr = os.Stderr
+// newSideBlob names the object holding path's new content: the index, or
+// the commit `zing suggest` describes.
+func newSideBlob(path string) string {
+	return diffTarget + ":" + path
+}
 
-			if err := editCmd.Run(); err != nil {
-				error_.Fprintf(os.Stderr, "Error opening editor: %v\n", err)
-				os.Exit(1)
-			}
+// matchTypeRule reports whether a path matches a type rule pattern.
+func matchTypeRule(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(path, pattern)
+	}
+	matched, _ := filepath.Match(pattern, path)
+	return matched
+}
 
-			if err := loadConfig(); err != nil {
-				error_.Fprintf(os.Stderr, "Error reloading config: %v\n", err)
-				os.Exit(1)
+// classifyTypeRules returns the type of the first matching rule for each file.
+// forced is set when every file matched and all rules agree on one type.
+func classifyTypeRules(files []FileChange, cfg *Config) (forced string, types map[string]string) {
+	types = make(map[string]string)
+	for _, file := range files {
+		for _, rule := range cfg.Commit.TypeRules {
+			if matchTypeRule(rule.Pattern, file.Path) {
+				types[file.Path] = rule.Type
+				break
 			}
-			info.Println("Configuration reloaded successfully")
-		},
+		}
 	}
 
-	// Add template command
+	if len(types) == 0 || len(types) != len(files) {
+		return "", types
+	}
+	for _, typ := range types {
+		if forced != "" && typ != forced {
+			return "", types
+		}
+		forced = typ
+	}
+	return forced, types
+}
+
+// branchTypeAliases maps common branch prefixes to conventional types.
+var branchTypeAliases = map[string]string{
+	"feature": "feat",
+	"bugfix":  "fix",
+	"hotfix":  "fix",
+}
+
+// typeFromBranch returns the commit type named by the branch prefix, such as
+// "fix" for fix/login-bug, when type_from_branch is enabled and the prefix is
+// one of the allowed types.
+func typeFromBranch(branch string, cfg *Config) string {
+	if cfg.Commit.TypeFromBranch == "" {
+		return ""
+	}
+	prefix, _, found := strings.Cut(branch, "/")
+	if !found {
+		return ""
+	}
+	prefix = strings.ToLower(prefix)
+	if alias, ok := branchTypeAliases[prefix]; ok {
+		prefix = alias
+	}
+	for _, allowed := range cfg.Commit.ScopePrefix {
+		if prefix == allowed {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// forceCommitType replaces the type of a conventional commit subject.
+func forceCommitType(message, typ string) string {
+	match := commitTypeRegex.FindStringSubmatch(message)
+	if match == nil {
+		return message
+	}
+	return typ + message[len(match[1]):]
+}
+
+// genericDirs are directory names too broad to make a useful scope.
+var genericDirs = map[string]bool{
+	"src": true, "internal": true, "pkg": true, "lib": true, "cmd": true, "app": true,
+}
+
+// detectScope returns the deepest directory shared by all changed files, for
+// example "auth" when everything lives under internal/auth/. It returns an
+// empty string when files span multiple top-level directories or the repo root.
+func detectScope(files []FileChange) string {
+	var common []string
+	for i, file := range files {
+		dir := filepath.ToSlash(filepath.Dir(file.Path))
+		if dir == "." {
+			return ""
+		}
+		parts := strings.Split(dir, "/")
+		if i == 0 {
+			common = parts
+			continue
+		}
+
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		if n == 0 {
+			return ""
+		}
+		common = common[:n]
+	}
+
+	if len(common) == 0 {
+		return ""
+	}
+	scope := common[len(common)-1]
+	if genericDirs[scope] {
+		return ""
+	}
+	return scope
+}
+
+// breakingAnalyzers are best-effort, per-language checks for changes that
+// likely break callers. Each returns one short description per finding.
+var breakingAnalyzers = map[string]func(FileChange) []string{
+	"Go": goBreakingChanges,
+}
+
+var (
+	goFuncRegex      = regexp.MustCompile(`^func (?:\(([^)]*)\) )?([A-Z]\w*)(.*)$`)
+	goTypeRegex      = regexp.MustCompile(`^type ([A-Z]\w*)\b`)
+	manifestVersion  = regexp.MustCompile(`^\s*"?version"?\s*[:=]\s*"v?(\d+)\.`)
+	goModuleRegex    = regexp.MustCompile(`^module\s+(\S+)`)
+	configKeyRegex   = regexp.MustCompile(`^\s*"?([A-Za-z0-9_.-]+)"?\s*[:=]`)
+	configLanguages  = map[string]bool{"TOML": true, "YAML": true, "JSON": true}
+	versionManifests = map[string]bool{"package.json": true, "cargo.toml": true, "pyproject.toml": true}
+)
+
+// diffLines returns the removed and added lines of a diff without their
+// leading -/+ markers, skipping the ---/+++ file headers.
+func diffLines(diff string) (removed, added []string) {
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+		case strings.HasPrefix(line, "-"):
+			removed = append(removed, line[1:])
+		case strings.HasPrefix(line, "+"):
+			added = append(added, line[1:])
+		}
+	}
+	return removed, added
+}
+
+// detectBreakingChanges runs the language analyzers plus the manifest and
+// config checks over every file.
+func detectBreakingChanges(files []FileChange) []string {
+	var found []string
+	for _, file := range files {
+		if file.IsBinary || file.Status == "Added" {
+			continue
+		}
+		if analyze, ok := breakingAnalyzers[file.Language]; ok {
+			found = append(found, analyze(file)...)
+		}
+		found = append(found, manifestBreakingChanges(file)...)
+		found = append(found, configBreakingChanges(file)...)
+	}
+	return found
+}
+
+// goBreakingChanges reports exported functions, methods and types that were
+// removed or whose signature changed. Tests and internal packages are
+// skipped since nothing outside the module can use them.
+func goBreakingChanges(file FileChange) []string {
+	path := filepath.ToSlash(file.Path)
+	if strings.HasSuffix(path, "_test.go") || strings.HasPrefix(path, "internal/") || strings.Contains(path, "/internal/") {
+		return nil
+	}
+
+	// Key functions by receiver type and name, since receiver names vary
+	funcs := func(lines []string) (map[string]string, map[string]bool) {
+		sigs, types := make(map[string]string), make(map[string]bool)
+		for _, line := range lines {
+			if match := goFuncRegex.FindStringSubmatch(line); match != nil {
+				receiver := ""
+				if fields := strings.Fields(match[1]); len(fields) > 0 {
+					receiver = strings.TrimLeft(fields[len(fields)-1], "*")
+					if receiver == "" || !unicode.IsUpper(rune(receiver[0])) {
+						continue
+					}
+					receiver += "."
+				}
+				sigs[receiver+match[2]] = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(match[3]), "{"))
+			} else if match := goTypeRegex.FindStringSubmatch(line); match != nil {
+				types[match[1]] = true
+			}
+		}
+		return sigs, types
+	}
+	removed, added := diffLines(file.Diff)
+	oldFuncs, oldTypes := funcs(removed)
+	newFuncs, newTypes := funcs(added)
+
+	var found []string
+	for _, name := range slices.Sorted(maps.Keys(oldFuncs)) {
+		newSig, ok := newFuncs[name]
+		switch {
+		case !ok:
+			found = append(found, fmt.Sprintf("removed exported func %s from %s", name, file.Path))
+		case newSig != oldFuncs[name]:
+			found = append(found, fmt.Sprintf("changed the signature of %s in %s", name, file.Path))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(oldTypes)) {
+		if !newTypes[name] {
+			found = append(found, fmt.Sprintf("removed exported type %s from %s", name, file.Path))
+		}
+	}
+	return found
+}
+
+// manifestBreakingChanges reports a major version bump in a package manifest
+// and a new major version suffix on a Go module path.
+func manifestBreakingChanges(file FileChange) []string {
+	base := strings.ToLower(filepath.Base(file.Path))
+	removed, added := diffLines(file.Diff)
+	var pattern *regexp.Regexp
+	switch {
+	case versionManifests[base]:
+		pattern = manifestVersion
+	case base == "go.mod":
+		pattern = goModuleRegex
+	default:
+		return nil
+	}
+
+	first := func(lines []string) string {
+		for _, line := range lines {
+			if match := pattern.FindStringSubmatch(line); match != nil {
+				return match[1]
+			}
+		}
+		return ""
+	}
+	oldValue, newValue := first(removed), first(added)
+	if oldValue == "" || newValue == "" || oldValue == newValue {
+		return nil
+	}
+	if base == "go.mod" {
+		return []string{fmt.Sprintf("changed the module path from %s to %s", oldValue, newValue)}
+	}
+	oldMajor, _ := strconv.Atoi(oldValue)
+	newMajor, _ := strconv.Atoi(newValue)
+	if newMajor <= oldMajor {
+		return nil
+	}
+	return []string{fmt.Sprintf("bumped the major version from %d to %d in %s", oldMajor, newMajor, file.Path)}
+}
+
+// configBreakingChanges reports keys removed from config files, meaning TOML,
+// YAML or JSON files with "config" or "settings" in their name. A key that is
+// only changed shows up on both sides and is not reported.
+func configBreakingChanges(file FileChange) []string {
+	base := strings.ToLower(filepath.Base(file.Path))
+	if !configLanguages[file.Language] || !(strings.Contains(base, "config") || strings.Contains(base, "settings")) {
+		return nil
+	}
+	keys := func(lines []string) map[string]bool {
+		set := make(map[string]bool)
+		for _, line := range lines {
+			if match := configKeyRegex.FindStringSubmatch(line); match != nil {
+				set[match[1]] = true
+			}
+		}
+		return set
+	}
+	removed, added := diffLines(file.Diff)
+	oldKeys, newKeys := keys(removed), keys(added)
+
+	var found []string
+	for _, key := range slices.Sorted(maps.Keys(oldKeys)) {
+		if !newKeys[key] {
+			found = append(found, fmt.Sprintf("removed config key %s from %s", key, file.Path))
+		}
+	}
+	return found
+}
+
+func getGitInfo() (*GitInfo, error) {
+	gitInfo := &GitInfo{}
+
+	// Get current branch
+	branchCmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	branchOutput, err := branchCmd.Output()
+	if err == nil {
+		gitInfo.Branch = strings.TrimSpace(string(branchOutput))
+		// Extract issue references for the configured tracker
+		switch config.Commit.IssueTracker {
+		case "github", "gitlab":
+			gitInfo.IssueRefs = extractIssueRefs(gitInfo.Branch)
+		default:
+			if config.Commit.JiraIntegration {
+				gitInfo.JiraTicket = extractJiraTicket(gitInfo.Branch)
+			}
+		}
+	}
+
+	// Get last commit hash
+	hashCmd := exec.Command("git", "rev-parse", "HEAD")
+	hashOutput, err := hashCmd.Output()
+	if err == nil {
+		gitInfo.LastCommit = strings.TrimSpace(string(hashOutput))
+	}
+
+	if config.Commit.HistoryContext > 0 && gitInfo.LastCommit != "" {
+		args := []string{"log", "-n", strconv.Itoa(config.Commit.HistoryContext), "--no-merges", "--format=%s"}
+		if diffTarget != "" {
+			// Only history older than the commit being described
+			args = append(args, diffBase)
+		}
+		history, err := exec.Command("git", args...).Output()
+		if err != nil {
+			debugLog("Could not read recent commits: %v", err)
+		}
+		for _, subject := range strings.Split(strings.TrimSpace(string(history)), "\n") {
+			if subject != "" {
+				gitInfo.History = append(gitInfo.History, subject)
+			}
+		}
+	}
+
+	if config.Commit.UseGitTemplate {
+		gitInfo.GitTemplate = gitCommitTemplate()
+	}
+
+	// Get staged files
+	cmd := exec.Command("git", cachedDiffArgs("--name-status", "-z")...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error getting staged files: %w", err)
+	}
+
+	entries := parseNameStatus(output)
+
+	// Collect all diffs with two git calls, falling back to per-file calls if
+	// the batched output can't be aligned with the file list
+	files, err := collectBatchedFileChanges(entries)
+	if err != nil {
+		debugLog("Falling back to per-file diffs: %v", err)
+		var kept []nameStatusEntry
+		for _, entry := range entries {
+			if isIgnoredPath(entry.Path) {
+				gitInfo.IgnoredFiles = append(gitInfo.IgnoredFiles, FileChange{
+					Path:    entry.Path,
+					OldPath: entry.OldPath,
+					Status:  parseGitStatus(entry.Status),
+				})
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		files, err = collectFileChanges(kept)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fileChange := range files {
+		if isIgnoredPath(fileChange.Path) {
+			gitInfo.IgnoredFiles = append(gitInfo.IgnoredFiles, fileChange)
+			continue
+		}
+		gitInfo.TotalChanges.Additions += fileChange.Addition
+		gitInfo.TotalChanges.Deletions += fileChange.Deletion
+		gitInfo.Files = append(gitInfo.Files, fileChange)
+	}
+
+	return gitInfo, nil
+}
+
+// gitCommitTemplate returns git's commit.template without its comment
+// lines, or "" when none is configured or it cannot be read.
+func gitCommitTemplate() string {
+	output, err := exec.Command("git", "config", "--path", "commit.template").Output()
+	path := strings.TrimSpace(string(output))
+	if err != nil || path == "" {
+		return ""
+	}
+	// Like git, resolve a relative template from the top of the work tree
+	if !filepath.IsAbs(path) {
+		if top, err := exec.Command("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+			path = filepath.Join(strings.TrimSpace(string(top)), path)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		warn.Printf("Could not read commit.template: %v\n", err)
+		return ""
+	}
+	return stripCommentLines(string(data))
+}
+
+// stripCommentLines drops the "#" lines git treats as comments in a message
+// and trims trailing whitespace.
+func stripCommentLines(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimRight(line, " \t\r"))
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+type nameStatusEntry struct {
+	Status  string
+	Path    string
+	OldPath string
+}
+
+// parseNameStatus parses the NUL-delimited output of `git diff --name-status -z`.
+// Renames and copies carry a source and a destination path, e.g. "R100\0old\0new".
+func parseNameStatus(output []byte) []nameStatusEntry {
+	var entries []nameStatusEntry
+	tokens := strings.Split(strings.TrimRight(string(output), "\x00"), "\x00")
+	for i := 0; i < len(tokens); i++ {
+		status := tokens[i]
+		if status == "" {
+			continue
+		}
+
+		paths := 1
+		if status[0] == 'R' || status[0] == 'C' {
+			paths = 2
+		}
+		if i+paths >= len(tokens) {
+			break
+		}
+
+		entry := nameStatusEntry{
+			Status: status,
+			Path:   tokens[i+paths],
+		}
+		if paths == 2 {
+			entry.OldPath = tokens[i+1]
+		}
+		entries = append(entries, entry)
+		i += paths
+	}
+	return entries
+}
+
+// parseNumstat returns the added and deleted counts from the first record of
+// `git diff --numstat -z` output.
+func parseNumstat(output []byte) []string {
+	record, _, _ := strings.Cut(string(output), "\x00")
+	fields := strings.SplitN(record, "\t", 3)
+	if len(fields) < 2 {
+		return nil
+	}
+	return fields[:2]
+}
+
+// topPathspec anchors a repository-relative path so git resolves it from the
+// top level regardless of the current directory.
+func topPathspec(path string) string {
+	return ":(top,literal)" + path
+}
+
+// languageExcluded reports whether the language filters keep a file's diff
+// out of the prompt. The file still counts towards the stats. A non-empty
+// include_languages wins over exclude_languages.
+func languageExcluded(language string, cfg *Config) bool {
+	matches := func(languages []string) bool {
+		for _, candidate := range languages {
+			if strings.EqualFold(candidate, language) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(cfg.System.IncludeLanguages) > 0 {
+		return !matches(cfg.System.IncludeLanguages)
+	}
+	return matches(cfg.System.ExcludeLanguages)
+}
+
+// isIgnoredPath reports whether a path matches system.ignore_paths.
+func isIgnoredPath(path string) bool {
+	for _, pattern := range config.System.IgnorePaths {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// collectBatchedFileChanges builds every FileChange from a single numstat
+// call and a single diff call. git emits file pairs in the same order for
+// --name-status, --numstat and the patch, so the outputs are zipped by index.
+func collectBatchedFileChanges(entries []nameStatusEntry) ([]FileChange, error) {
+	numstatOutput, err := exec.Command("git", cachedDiffArgs("--no-color", "--numstat", "-z")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error getting numstat: %w", err)
+	}
+	diffOutput, err := exec.Command("git", diffArgs()...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error getting diff: %w", err)
+	}
+
+	stats := parseNumstatRecords(numstatOutput)
+	diffs := splitDiffByFile(string(diffOutput))
+	if len(stats) != len(entries) || len(diffs) != len(entries) {
+		return nil, fmt.Errorf("got %d files, %d numstat records and %d diffs", len(entries), len(stats), len(diffs))
+	}
+
+	files := make([]FileChange, len(entries))
+	for i, entry := range entries {
+		if stats[i].Path != entry.Path {
+			return nil, fmt.Errorf("numstat record %q does not match %q", stats[i].Path, entry.Path)
+		}
+
+		diff := diffs[i]
+		oldMode, newMode := parseModeChange(diff)
+		if config.System.HunkContextOnly {
+			diff = stripDiffHeaders(diff)
+		}
+		files[i] = FileChange{
+			Path:     entry.Path,
+			OldPath:  entry.OldPath,
+			Status:   parseGitStatus(entry.Status),
+			IsBinary: stats[i].Binary,
+			Diff:     diff,
+			Language: detectLanguage(entry.Path, diff, newSideBlob(entry.Path)),
+			Addition: stats[i].Additions,
+			Deletion: stats[i].Deletions,
+			OldMode:  oldMode,
+			NewMode:  newMode,
+		}
+	}
+	return files, nil
+}
+
+// collectFileChanges gathers per-file diffs concurrently, bounded by
+// max_concurrent. Results are stored by index so the original order is kept.
+// It fails if any file cannot be read, rather than describe part of the change.
+func collectFileChanges(entries []nameStatusEntry) ([]FileChange, error) {
+	workers := config.System.MaxConcurrent
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]FileChange, len(entries))
+	errs := make([]error, len(entries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = collectFileChange(entries[i])
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	failed := 0
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("could not read %d of %d staged files: %w", failed, len(entries), firstErr)
+	}
+	return results, nil
+}
+
+// collectFileChange gathers the diff and line stats for one staged file.
+func collectFileChange(entry nameStatusEntry) (FileChange, error) {
+	path := entry.Path
+
+	// Get file diff
+	diff, err := getFileDiff(path)
+	if err != nil {
+		return FileChange{}, fmt.Errorf("could not get diff for %s: %w", path, err)
+	}
+
+	// Check if file is binary
+	cmd := exec.Command("git", cachedDiffArgs("--numstat", "-z", "--", topPathspec(path))...)
+	stats, err := cmd.Output()
+	if err != nil {
+		return FileChange{}, fmt.Errorf("could not get stats for %s: %w", path, err)
+	}
+
+	statsFields := parseNumstat(stats)
+	isBinary := len(statsFields) >= 2 && statsFields[0] == "-" && statsFields[1] == "-"
+
+	oldMode, newMode := parseModeChange(diff)
+	if config.System.HunkContextOnly {
+		diff = stripDiffHeaders(diff)
+	}
+
+	fileChange := FileChange{
+		Path:     path,
+		OldPath:  entry.OldPath,
+		Status:   parseGitStatus(entry.Status),
+		IsBinary: isBinary,
+		Diff:     diff,
+		Language: detectLanguage(path, diff, newSideBlob(path)),
+		OldMode:  oldMode,
+		NewMode:  newMode,
+	}
+
+	if !isBinary && len(statsFields) >= 2 {
+		fileChange.Addition, _ = strconv.Atoi(statsFields[0])
+		fileChange.Deletion, _ = strconv.Atoi(statsFields[1])
+	}
+	return fileChange, nil
+}
+
+// unstagedFiles lists files with unstaged changes, including untracked files
+// that are not ignored, relative to the repository root.
+func unstagedFiles() ([]string, error) {
+	output, err := exec.Command("git", "status", "--porcelain", "-z", "--untracked-files=all").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error getting unstaged files: %w", err)
+	}
+
+	var files []string
+	records := strings.Split(strings.TrimRight(string(output), "\x00"), "\x00")
+	for i := 0; i < len(records); i++ {
+		record := records[i]
+		if len(record) < 4 {
+			continue
+		}
+		status, path := record[:2], record[3:]
+		// Renames carry the source path as an extra record
+		if status[0] == 'R' || status[0] == 'C' {
+			i++
+		}
+		if status == "??" || status[1] != ' ' {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// parseSelection turns input such as "1 3", "2,4-6" or "a" into indexes
+// below n.
+func parseSelection(input string, n int) ([]int, error) {
+	input = strings.TrimSpace(strings.ToLower(input))
+	if input == "a" || input == "all" {
+		indexes := make([]int, n)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+
+	var indexes []int
+	seen := make(map[int]bool)
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		first, last, isRange := strings.Cut(field, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 1 || end > n || start > end {
+			return nil, fmt.Errorf("invalid selection %q: use numbers from 1 to %d", field, n)
+		}
+		for i := start; i <= end; i++ {
+			if !seen[i-1] {
+				seen[i-1] = true
+				indexes = append(indexes, i-1)
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// stageInteractively offers the unstaged files for staging when nothing is
+// staged yet. It does nothing if changes are already staged.
+func stageInteractively() error {
+	if err := exec.Command("git", cachedDiffArgs("--quiet")...).Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return nil
+		}
+		return fmt.Errorf("error checking staged changes: %w", err)
+	}
+
+	files, err := unstagedFiles()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+
+	fmt.Println("Nothing is staged. Unstaged changes:")
+	for i, file := range files {
+		fmt.Printf("  %d) %s\n", i+1, file)
+	}
+	fmt.Print("Stage which files? (e.g. 1 3, 2-4, a for all, empty to cancel) ")
+	response, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(response) == "" {
+		return fmt.Errorf("nothing staged")
+	}
+	indexes, err := parseSelection(response, len(files))
+	if err != nil {
+		return err
+	}
+
+	args := []string{"add", "--"}
+	for _, i := range indexes {
+		args = append(args, topPathspec(files[i]))
+	}
+	addCmd := exec.Command("git", args...)
+	addCmd.Stderr = os.Stderr
+	if err := addCmd.Run(); err != nil {
+		return fmt.Errorf("error staging files: %w", err)
+	}
+	return nil
+}
+
+// filterStagedFiles narrows gitInfo to the given paths, which are relative to
+// the current directory. It errors if any path is not staged.
+func filterStagedFiles(gitInfo *GitInfo, paths []string) error {
+	prefixOutput, err := exec.Command("git", "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return fmt.Errorf("error resolving repository prefix: %w", err)
+	}
+	prefix := strings.TrimSpace(string(prefixOutput))
+
+	staged := make(map[string]FileChange)
+	for _, file := range gitInfo.Files {
+		staged[file.Path] = file
+	}
+	ignored := make(map[string]FileChange)
+	for _, file := range gitInfo.IgnoredFiles {
+		ignored[file.Path] = file
+	}
+
+	var files, ignoredFiles []FileChange
+	gitInfo.TotalChanges.Additions = 0
+	gitInfo.TotalChanges.Deletions = 0
+	for _, p := range paths {
+		repoPath := filepath.ToSlash(filepath.Clean(filepath.Join(prefix, p)))
+		if file, ok := ignored[repoPath]; ok {
+			ignoredFiles = append(ignoredFiles, file)
+			continue
+		}
+		file, ok := staged[repoPath]
+		if !ok {
+			return fmt.Errorf("%s is not staged", p)
+		}
+		files = append(files, file)
+		gitInfo.TotalChanges.Additions += file.Addition
+		gitInfo.TotalChanges.Deletions += file.Deletion
+	}
+	gitInfo.Files = files
+	gitInfo.IgnoredFiles = ignoredFiles
+	return nil
+}
+
+func parseGitStatus(status string) string {
+	switch status[0] {
+	case 'A':
+		return "Added"
+	case 'M':
+		return "Modified"
+	case 'D':
+		return "Deleted"
+	case 'R':
+		return "Renamed"
+	case 'C':
+		return "Copied"
+	case 'U':
+		return "Unmerged"
+	default:
+		return "Unknown"
+	}
+}
+
+// cachedDiffArgs returns `git diff --cached` arguments comparing the index
+// against diffBase, or HEAD when no base is set. With a diffTarget the two
+// revisions are compared instead and the index is left out.
+func cachedDiffArgs(extra ...string) []string {
+	if diffTarget != "" {
+		return append([]string{"diff", diffBase, diffTarget}, extra...)
+	}
+	args := []string{"diff", "--cached"}
+	if diffBase != "" {
+		args = append(args, diffBase)
+	}
+	return append(args, extra...)
+}
+
+// emptyTreeHash is git's well-known empty tree, the parent of a root commit.
+const emptyTreeHash = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// resolveCommitRange returns the first parent of rev and rev itself as
+// commit hashes, using the empty tree as the parent of a root commit.
+func resolveCommitRange(rev string) (string, string, error) {
+	output, err := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("unknown revision %q", rev)
+	}
+	target := strings.TrimSpace(string(output))
+
+	output, err = exec.Command("git", "rev-parse", "--verify", "--quiet", target+"^").Output()
+	if err != nil {
+		return emptyTreeHash, target, nil
+	}
+	return strings.TrimSpace(string(output)), target, nil
+}
+
+// resolvePushBase returns the commit the current branch was last pushed to
+// and the subjects of the commits made since.
+func resolvePushBase() (string, []string, error) {
+	output, err := exec.Command("git", "rev-parse", "--verify", "--quiet", "@{push}").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("the current branch has no push destination; push it once with `git push -u` first")
+	}
+	base := strings.TrimSpace(string(output))
+
+	logOutput, err := exec.Command("git", "log", "--format=%s", base+"..HEAD").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("error listing unpushed commits: %w", err)
+	}
+	var subjects []string
+	for _, line := range strings.Split(strings.TrimSpace(string(logOutput)), "\n") {
+		if line != "" {
+			subjects = append(subjects, line)
+		}
+	}
+	return base, subjects, nil
+}
+
+// diffArgs returns the `git diff --cached` arguments for the configured
+// diff format. Color and external diff drivers are always disabled so the
+// output can be parsed.
+func diffArgs() []string {
+	args := cachedDiffArgs("--no-color", "--no-ext-diff")
+	switch config.Display.DiffFormat {
+	case "minimal":
+		args = append(args, "--minimal")
+	case "patience":
+		args = append(args, "--patience")
+	}
+	return args
+}
+
+func getFileDiff(file string) (string, error) {
+	args := append(diffArgs(), "--", topPathspec(file))
+
+	cmd := exec.Command("git", args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("error getting file diff: %w", err)
+	}
+	return string(output), nil
+}
+
+type numstatRecord struct {
+	Additions int
+	Deletions int
+	Binary    bool
+	Path      string // Destination path for renames and copies
+	OldPath   string // Source path for renames and copies
+}
+
+// parseNumstatRecords parses `git diff --numstat -z` output. Each record is
+// "added\tdeleted\tpath\0", or "added\tdeleted\t\0old\0new\0" for renames
+// and copies. Binary files report "-" for both counts.
+func parseNumstatRecords(output []byte) []numstatRecord {
+	var records []numstatRecord
+	tokens := strings.Split(strings.TrimRight(string(output), "\x00"), "\x00")
+	for i := 0; i < len(tokens); i++ {
+		fields := strings.SplitN(tokens[i], "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+
+		record := numstatRecord{
+			Binary: fields[0] == "-" && fields[1] == "-",
+			Path:   fields[2],
+		}
+		if !record.Binary {
+			record.Additions, _ = strconv.Atoi(fields[0])
+			record.Deletions, _ = strconv.Atoi(fields[1])
+		}
+		if record.Path == "" && i+2 < len(tokens) {
+			record.OldPath = tokens[i+1]
+			record.Path = tokens[i+2]
+			i += 2
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// splitDiffByFile splits a multi-file patch into one chunk per file pair.
+// Content lines are always prefixed, so only headers start with "diff --git ".
+func splitDiffByFile(diff string) []string {
+	var chunks []string
+	start := -1
+	for offset := 0; offset < len(diff); {
+		end := strings.IndexByte(diff[offset:], '\n')
+		if end == -1 {
+			end = len(diff)
+		} else {
+			end += offset + 1
+		}
+		if strings.HasPrefix(diff[offset:], "diff --git ") {
+			if start != -1 {
+				chunks = append(chunks, diff[start:offset])
+			}
+			start = offset
+		}
+		offset = end
+	}
+	if start != -1 {
+		chunks = append(chunks, diff[start:])
+	}
+	return chunks
+}
+
+// parseUnifiedDiff turns git-style diff output, as read by --stdin, into
+// file changes without consulting the repository. Line counts come from the
+// hunks since there is no numstat to ask.
+func parseUnifiedDiff(diff string) []FileChange {
+	var files []FileChange
+	for _, chunk := range splitDiffByFile(diff) {
+		file := FileChange{Status: "Modified", Diff: chunk}
+		var oldPath, newPath string
+		inHunk := false
+		for _, line := range strings.Split(chunk, "\n") {
+			if inHunk {
+				switch {
+				case strings.HasPrefix(line, "+"):
+					file.Addition++
+				case strings.HasPrefix(line, "-"):
+					file.Deletion++
+				}
+				continue
+			}
+			switch {
+			case strings.HasPrefix(line, "@@"):
+				inHunk = true
+			case strings.HasPrefix(line, "new file mode"):
+				file.Status = "Added"
+			case strings.HasPrefix(line, "deleted file mode"):
+				file.Status = "Deleted"
+			case strings.HasPrefix(line, "rename from "):
+				file.Status = "Renamed"
+				oldPath = strings.TrimPrefix(line, "rename from ")
+			case strings.HasPrefix(line, "rename to "):
+				newPath = strings.TrimPrefix(line, "rename to ")
+			case strings.HasPrefix(line, "copy from "):
+				file.Status = "Copied"
+				oldPath = strings.TrimPrefix(line, "copy from ")
+			case strings.HasPrefix(line, "copy to "):
+				newPath = strings.TrimPrefix(line, "copy to ")
+			case strings.HasPrefix(line, "Binary files "), strings.HasPrefix(line, "GIT binary patch"):
+				file.IsBinary = true
+			case strings.HasPrefix(line, "--- "):
+				if p := diffHeaderPath(line[4:], "a/"); p != "" && oldPath == "" {
+					oldPath = p
+				}
+			case strings.HasPrefix(line, "+++ "):
+				if p := diffHeaderPath(line[4:], "b/"); p != "" && newPath == "" {
+					newPath = p
+				}
+			}
+		}
+
+		// Mode-only and binary changes have no ---/+++ lines, so fall back to
+		// the "diff --git a/old b/new" header
+		if newPath == "" && oldPath == "" {
+			header, _, _ := strings.Cut(chunk, "\n")
+			header = strings.TrimPrefix(header, "diff --git ")
+			if i := strings.LastIndex(header, " b/"); i != -1 {
+				oldPath = strings.TrimPrefix(header[:i], "a/")
+				newPath = header[i+3:]
+			}
+		}
+		switch {
+		case newPath == "":
+			newPath = oldPath
+		case oldPath == "":
+			oldPath = newPath
+		}
+
+		file.Path = newPath
+		if file.Status == "Renamed" || file.Status == "Copied" {
+			file.OldPath = oldPath
+		}
+		if file.IsBinary {
+			file.Addition, file.Deletion = 0, 0
+		}
+		file.OldMode, file.NewMode = parseModeChange(file.Diff)
+		if config.System.HunkContextOnly {
+			file.Diff = stripDiffHeaders(file.Diff)
+		}
+		file.Language = detectLanguage(file.Path, file.Diff, "")
+		files = append(files, file)
+	}
+	return files
+}
+
+// diffHeaderPath extracts the path from a ---/+++ header line, dropping the
+// a/ or b/ prefix and any trailing timestamp. /dev/null yields "".
+func diffHeaderPath(header, prefix string) string {
+	path, _, _ := strings.Cut(header, "\t")
+	if path == "/dev/null" {
+		return ""
+	}
+	return strings.TrimPrefix(path, prefix)
+}
+
+// stdinGitInfo builds a GitInfo from a diff read from r, applying the same
+// ignore rules as the staged path.
+func stdinGitInfo(r io.Reader) (*GitInfo, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading diff from stdin: %w", err)
+	}
+	if strings.TrimSpace(string(input)) == "" {
+		return nil, fmt.Errorf("no diff provided on stdin")
+	}
+
+	files := parseUnifiedDiff(string(input))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("stdin does not contain a git diff (expected \"diff --git\" headers)")
+	}
+
+	gitInfo := &GitInfo{}
+	for _, fileChange := range files {
+		if isIgnoredPath(fileChange.Path) {
+			gitInfo.IgnoredFiles = append(gitInfo.IgnoredFiles, fileChange)
+			continue
+		}
+		gitInfo.TotalChanges.Additions += fileChange.Addition
+		gitInfo.TotalChanges.Deletions += fileChange.Deletion
+		gitInfo.Files = append(gitInfo.Files, fileChange)
+	}
+	if len(gitInfo.Files) == 0 && !config.System.StatFallback {
+		return nil, fmt.Errorf("all changes in the diff were filtered out by ignore rules")
+	}
+	return gitInfo, nil
+}
+
+// parseModeChange returns the "old mode" and "new mode" header values of a
+// single-file diff, or empty strings when the mode did not change.
+func parseModeChange(diff string) (string, string) {
+	var oldMode, newMode string
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, "@@") {
+			break
+		}
+		if mode, ok := strings.CutPrefix(line, "old mode "); ok {
+			oldMode = strings.TrimSpace(mode)
+		}
+		if mode, ok := strings.CutPrefix(line, "new mode "); ok {
+			newMode = strings.TrimSpace(mode)
+		}
+	}
+	return oldMode, newMode
+}
+
+// describeContentlessChange spells out changes that carry no diff lines,
+// such as pure renames and mode changes, so the model has something to
+// describe. It returns "" for changes with content.
+func describeContentlessChange(file FileChange) string {
+	if file.IsBinary || file.Addition > 0 || file.Deletion > 0 {
+		return ""
+	}
+	var notes []string
+	switch file.Status {
+	case "Renamed":
+		notes = append(notes, fmt.Sprintf("[Renamed %s to %s without changing its content]", file.OldPath, file.Path))
+	case "Copied":
+		notes = append(notes, fmt.Sprintf("[Copied %s to %s without changing its content]", file.OldPath, file.Path))
+	case "Added":
+		notes = append(notes, "[Added an empty file]")
+	case "Deleted":
+		notes = append(notes, "[Deleted an empty file]")
+	}
+	if file.OldMode != "" && file.NewMode != "" {
+		note := fmt.Sprintf("[Changed mode of %s from %s to %s", file.Path, file.OldMode, file.NewMode)
+		switch {
+		case file.NewMode == "100755":
+			note += ", making it executable"
+		case file.OldMode == "100755":
+			note += ", making it non-executable"
+		}
+		notes = append(notes, note+"]")
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return strings.Join(notes, "\n") + "\n"
+}
+
+// stripDiffHeaders drops the file-level header lines (diff --git, index,
+// mode and ---/+++ lines) from a single-file diff, keeping only the hunks.
+func stripDiffHeaders(diff string) string {
+	if strings.HasPrefix(diff, "@@") {
+		return diff
+	}
+	if i := strings.Index(diff, "\n@@"); i != -1 {
+		return diff[i+1:]
+	}
+	return ""
+}
+
+// MessageParts is the logical structure of a commit message.
+type MessageParts struct {
+	Subject  string   `json:"subject"`
+	Body     string   `json:"body"`
+	Trailers []string `json:"trailers"`
+}
+
+// JSONFile is the machine-readable summary of a staged file.
+type JSONFile struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"`
+	Status    string `json:"status"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary"`
+	Language  string `json:"language"`
+}
+
+// jsonSchemaVersion is bumped whenever a JSONOutput field changes meaning or
+// is removed. Adding fields does not bump it.
+const jsonSchemaVersion = 1
+
+// JSONOutput is printed by --output json for editor integrations.
+type JSONOutput struct {
+	SchemaVersion int        `json:"schema_version"`
+	Message       string     `json:"message"`
+	Subject       string     `json:"subject"`
+	Body          string     `json:"body"`
+	Trailers      []string   `json:"trailers"`
+	Files         []JSONFile `json:"files"`
+	Stats         struct {
+		Files     int `json:"files"`
+		Additions int `json:"additions"`
+		Deletions int `json:"deletions"`
+	} `json:"stats"`
+	Jira     string `json:"jira"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	DryRun   bool   `json:"dry_run"`
+	Commit   string `json:"commit,omitempty"` // Hash of the created commit
+}
+
+type CommitTemplateData struct {
+	Type        string   `json:"type"`
+	Scope       string   `json:"scope"`
+	Description string   `json:"description"`
+	Body        string   `json:"body"`
+	Breaking    string   `json:"breaking"`
+	Closes      string   `json:"closes"`
+	Rationale   string   `json:"rationale"` // Only requested by --explain; never rendered
+	JiraTicket  string   `json:"-"`
+	CoAuthors   []string `json:"-"`
+}
+
+// isPatchFile reports whether a staged file is itself a patch or diff.
+func isPatchFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".patch" || ext == ".diff"
+}
+
+// statFallbackMessage builds a deterministic message from the ignored files
+// when ignore rules leave nothing for the model to describe.
+func statFallbackMessage(gitInfo *GitInfo) string {
+	files := gitInfo.IgnoredFiles
+	if len(files) == 1 {
+		return fmt.Sprintf("chore: update %s", filepath.Base(files[0].Path))
+	}
+
+	additions, deletions := 0, 0
+	for _, file := range files {
+		additions += file.Addition
+		deletions += file.Deletion
+	}
+	return fmt.Sprintf("chore: update %d files (+%d/-%d)", len(files), additions, deletions)
+}
+
+// estimateTokens approximates the token count of s at four characters per
+// token, which is close enough for budgeting across providers.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// filesByRelevance orders files by the size of their change, largest first,
+// keeping diff order for ties. A prompt budget spends tokens in this order.
+func filesByRelevance(files []FileChange) []FileChange {
+	ordered := slices.Clone(files)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Addition+ordered[i].Deletion > ordered[j].Addition+ordered[j].Deletion
+	})
+	return ordered
+}
+
+// fitFilesToBudget splits files into those whose diffs fit within budget
+// tokens, chosen in relevance order, and those left for the file list. Both
+// keep diff order. Files too large to fit are skipped in favour of smaller
+// ones further down.
+func fitFilesToBudget(files []FileChange, budget int, cfg *Config) (kept, omitted []FileChange) {
+	// Start from the cost of listing every file, then swap entries for diffs
+	used := estimateTokens(formatFileChanges(nil, cfg)) + estimateTokens(formatOmittedFiles(files))
+	keep := make(map[string]bool)
+	header := estimateTokens(formatFileChanges(nil, cfg))
+	for _, file := range filesByRelevance(files) {
+		cost := estimateTokens(formatFileChanges([]FileChange{file}, cfg)) - header - estimateTokens(omittedFileLine(file))
+		if used+cost <= budget {
+			used += cost
+			keep[file.Path] = true
+		}
+	}
+	for _, file := range files {
+		if keep[file.Path] {
+			kept = append(kept, file)
+		} else {
+			omitted = append(omitted, file)
+		}
+	}
+	return kept, omitted
+}
+
+// formatOmittedFiles lists the files whose diffs did not fit the prompt.
+func formatOmittedFiles(files []FileChange) string {
+	if len(files) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("\nOther changed files (diffs omitted to fit the prompt):\n")
+	for _, file := range files {
+		out.WriteString(omittedFileLine(file))
+	}
+	return out.String()
+}
+
+func omittedFileLine(file FileChange) string {
+	return fmt.Sprintf("- %s (%s, +%d/-%d)\n", file.Path, file.Status, file.Addition, file.Deletion)
+}
+
+// formatFileChanges renders the per-file diff section of the prompt, before
+// the ai.max_prompt_tokens budget drops any diffs.
+func formatFileChanges(files []FileChange, cfg *Config) string {
+	var out strings.Builder
+	out.WriteString("Changed files:\n")
+	for _, file := range files {
+		if file.OldPath != "" {
+			out.WriteString(fmt.Sprintf("\n=== %s (%s from %s) ===\n", file.Path, file.Status, file.OldPath))
+		} else {
+			out.WriteString(fmt.Sprintf("\n=== %s (%s) ===\n", file.Path, file.Status))
+		}
+		switch {
+		case file.IsBinary:
+			out.WriteString("[Binary file]\n")
+		case isPatchFile(file.Path):
+			// A diff inside a diff confuses the model into describing the patch
+			// contents, so only describe the act of changing the patch file
+			out.WriteString(fmt.Sprintf("Changes: +%d/-%d lines\n", file.Addition, file.Deletion))
+			out.WriteString(fmt.Sprintf("[A patch file was %s; its content is omitted]\n", strings.ToLower(file.Status)))
+		case languageExcluded(file.Language, cfg):
+			out.WriteString(fmt.Sprintf("Changes: +%d/-%d lines\n", file.Addition, file.Deletion))
+			out.WriteString(fmt.Sprintf("[%s diff omitted by the language filter]\n", file.Language))
+		default:
+			out.WriteString(fmt.Sprintf("Changes: +%d/-%d lines\n", file.Addition, file.Deletion))
+			if note := describeContentlessChange(file); note != "" {
+				out.WriteString(note)
+				continue
+			}
+			out.WriteString(file.Diff)
+		}
+	}
+	return out.String()
+}
+
+// resolveCommitType applies the type rules: the type is pinned when every
+// file agrees, otherwise each matching file gets a suggestion. An enforced
+// branch type expresses explicit intent and takes precedence.
+func resolveCommitType(gitInfo *GitInfo, cfg *Config) (forced string, ruleTypes map[string]string) {
+	forced, ruleTypes = classifyTypeRules(gitInfo.Files, cfg)
+	if branchType := typeFromBranch(gitInfo.Branch, cfg); branchType != "" && cfg.Commit.TypeFromBranch == "enforce" {
+		forced = branchType
+	}
+	return forced, ruleTypes
+}
+
+// buildPrompt assembles the prompt for gitInfo under cfg, asking for a
+// rationale when explain is set. It does no I/O and reads no globals, and the
+// same input always gives the same prompt, which keeps the generation cache
+// effective. Anything fetched, such as the JIRA summary, history or breaking
+// changes, must already be on gitInfo. Problems that still give a usable
+// prompt, like a broken ai.prompt_template, are returned as warnings for the
+// caller to show.
+func buildPrompt(gitInfo *GitInfo, cfg *Config, explain bool) (string, []string) {
+	var warnings []string
+
+	var prompt strings.Builder
+
+	prompt.WriteString("Generate a commit message for the following changes:\n\n")
+	prompt.WriteString(fmt.Sprintf("Total Changes: +%d/-%d lines\n",
+		gitInfo.TotalChanges.Additions,
+		gitInfo.TotalChanges.Deletions))
+
+	// Add contextual information
+	if gitInfo.Branch != "" {
+		prompt.WriteString(fmt.Sprintf("\nBranch: %s\n", gitInfo.Branch))
+	}
+	if gitInfo.JiraTicket != "" {
+		prompt.WriteString(fmt.Sprintf("JIRA Ticket: %s\n", gitInfo.JiraTicket))
+	}
+	if gitInfo.JiraSummary != "" {
+		prompt.WriteString(fmt.Sprintf("JIRA Summary: %s\n", gitInfo.JiraSummary))
+	}
+	if len(gitInfo.IssueRefs) > 0 {
+		prompt.WriteString(fmt.Sprintf("Issue References: %s\n", strings.Join(gitInfo.IssueRefs, ", ")))
+	}
+
+	// Add language-specific context
+	languageStats := make(map[string]int)
+	for _, file := range gitInfo.Files {
+		languageStats[file.Language]++
+	}
+	// Most files first, then by name, so identical changes give identical
+	// prompts and hit the generation cache
+	languages := slices.Collect(maps.Keys(languageStats))
+	sort.Slice(languages, func(i, j int) bool {
+		if languageStats[languages[i]] != languageStats[languages[j]] {
+			return languageStats[languages[i]] > languageStats[languages[j]]
+		}
+		return languages[i] < languages[j]
+	})
+	prompt.WriteString("\nLanguages affected:\n")
+	for _, lang := range languages {
+		prompt.WriteString(fmt.Sprintf("- %s (%d files)\n", lang, languageStats[lang]))
+	}
+
+	// What follows the file changes is built first so their budget is known
+	var instructions strings.Builder
+
+	forcedType, ruleTypes := resolveCommitType(gitInfo, cfg)
+	branchType := typeFromBranch(gitInfo.Branch, cfg)
+	if branchType != "" && forcedType == "" {
+		instructions.WriteString(fmt.Sprintf("\nSuggested type from branch name: %s\n", branchType))
+	}
+	if forcedType != "" {
+		instructions.WriteString(fmt.Sprintf("\nThe commit type MUST be: %s\n", forcedType))
+	} else if len(ruleTypes) > 0 {
+		instructions.WriteString("\nSuggested types by path:\n")
+		for _, file := range gitInfo.Files {
+			if typ, ok := ruleTypes[file.Path]; ok {
+				instructions.WriteString(fmt.Sprintf("- %s: %s\n", file.Path, typ))
+			}
+		}
+	}
+
+	// Suggest a scope derived from the changed paths, unless verification
+	// would reject it
+	if cfg.Commit.IncludeScope {
+		if scope := detectScope(gitInfo.Files); scope != "" && validateScope(scope, cfg) == nil {
+			instructions.WriteString(fmt.Sprintf("\nSuggested scope: %s\n", scope))
+		}
+		if len(cfg.Commit.AllowedScopes) > 0 {
+			instructions.WriteString(fmt.Sprintf("\nThe scope MUST be empty or match one of: %s\n", strings.Join(cfg.Commit.AllowedScopes, ", ")))
+		}
+	}
+
+	if len(gitInfo.Unpushed) > 0 {
+		instructions.WriteString("\nThese changes combine the following unpushed commits with anything staged. Write one cohesive message for all of them:\n")
+		for _, subject := range gitInfo.Unpushed {
+			instructions.WriteString(fmt.Sprintf("- %s\n", subject))
+		}
+	}
+
+	if len(gitInfo.Breaking) > 0 {
+		instructions.WriteString("\nThe diff very likely contains breaking changes:\n")
+		for _, change := range gitInfo.Breaking {
+			instructions.WriteString(fmt.Sprintf("- %s\n", change))
+		}
+		instructions.WriteString("Unless they are clearly internal, describe them in the \"breaking\" field.\n")
+	}
+
+	// Recent subjects show the repository's voice, such as its scope names.
+	// They count against max_prompt_tokens before any diff does.
+	if len(gitInfo.History) > 0 {
+		instructions.WriteString("\nRecent commit subjects for style reference:\n")
+		for _, subject := range gitInfo.History {
+			instructions.WriteString(fmt.Sprintf("- %s\n", subject))
+		}
+	}
+
+	if gitInfo.GitTemplate != "" {
+		instructions.WriteString(fmt.Sprintf("\nThis commit template is appended to the message automatically, so do not repeat it:\n%s\n", gitInfo.GitTemplate))
+	}
+
+	if len(gitInfo.Rejected) > 0 {
+		instructions.WriteString("\nThe author rejected these messages, so write a different one:\n")
+		for _, message := range gitInfo.Rejected {
+			instructions.WriteString(fmt.Sprintf("- %s\n", strings.SplitN(message, "\n", 2)[0]))
+		}
+	}
+
+	// The author knows the intent better than the diff does
+	if context := strings.TrimSpace(gitInfo.Context); context != "" {
+		instructions.WriteString(fmt.Sprintf("\nAdditional context from author:\n%s\n", context))
+	}
+
+	// Add style instructions
+	rules, err := renderPromptRules(gitInfo, cfg)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Could not render ai.prompt_template, using the built-in rules: %v", err))
+	}
+	instructions.WriteString(rules)
+	if language := messageLanguage(cfg); language != "" {
+		instructions.WriteString(fmt.Sprintf("\n\nWrite the description and body in %s. Keep the type keywords such as feat and fix, and the JSON field names, in English.", language))
+	}
+
+	// Ask for structured output so the active template can render it
+	instructions.WriteString(`
+
+Respond with only a JSON object with these string fields (use "" when not applicable):
+{"type": "", "scope": "", "description": "", "body": "", "breaking": "", "closes": ""}`)
+	if explain {
+		instructions.WriteString(`
+Also add a "rationale" field with one line explaining why you chose this type, scope and description.`)
+	}
+
+	// Add file changes, dropping the least relevant diffs past the budget
+	fileSection := formatFileChanges(gitInfo.Files, cfg)
+	if cfg.AI.MaxPromptTokens > 0 {
+		budget := cfg.AI.MaxPromptTokens - estimateTokens(prompt.String()) - estimateTokens(instructions.String())
+		kept, omitted := fitFilesToBudget(gitInfo.Files, budget, cfg)
+		if len(omitted) > 0 {
+			fileSection = formatFileChanges(kept, cfg) + formatOmittedFiles(omitted)
+		}
+	}
+	prompt.WriteString("\n")
+	prompt.WriteString(fileSection)
+	prompt.WriteString(instructions.String())
+	return prompt.String(), warnings
+}
+
+// addJiraSummary enriches gitInfo with the ticket summary. Failures are
+// non-fatal so offline use works.
+func addJiraSummary(gitInfo *GitInfo) {
+	if gitInfo.JiraTicket != "" && config.Commit.JiraURL != "" && gitInfo.JiraSummary == "" {
+		summary, err := fetchJiraSummary(gitInfo.JiraTicket)
+		if err != nil {
+			warn.Printf("Could not fetch JIRA ticket %s: %v\n", gitInfo.JiraTicket, err)
+		}
+		gitInfo.JiraSummary = summary
+	}
+}
+
+// preparePrompt builds the prompt that is sent for gitInfo and runs it
+// through system.prompt_filter_command. Generation and `zing preview` both
+// use it, so the preview is what the provider gets.
+func preparePrompt(gitInfo *GitInfo) (string, error) {
+	if config.Commit.IncludeBreaking {
+		gitInfo.Breaking = detectBreakingChanges(gitInfo.Files)
+		if len(gitInfo.Breaking) > 0 {
+			debugLog("Likely breaking changes:\n- %s", strings.Join(gitInfo.Breaking, "\n- "))
+		}
+	}
+
+	prompt, warnings := buildPrompt(gitInfo, &config, explainMode)
+	for _, warning := range warnings {
+		warn.Println(warning)
+	}
+
+	// Fail closed: if the filter breaks, the unfiltered prompt is never sent
+	if command := config.System.PromptFilterCommand; command != "" {
+		filtered, err := runFilterCommand("system.prompt_filter_command", command, prompt)
+		if err != nil {
+			return "", err
+		}
+		if filtered == "" {
+			return "", fmt.Errorf("system.prompt_filter_command printed no prompt")
+		}
+		prompt = filtered
+	}
+	return prompt, nil
+}
+
+func generateCommitMessage(gitInfo *GitInfo) (string, error) {
+	addJiraSummary(gitInfo)
+
+	// Everything was filtered out, so describe the change from its stats alone
+	if len(gitInfo.Files) == 0 {
+		return runPostProcessCommand(postProcessCommitMessage(statFallbackMessage(gitInfo), gitInfo))
+	}
+
+	prompt, err := preparePrompt(gitInfo)
+	if err != nil {
+		return "", err
+	}
+	forcedType, _ := resolveCommitType(gitInfo, &config)
+
+	debugLog("Generated prompt:\n%s", prompt)
+	debugLog("Using provider %s with model %s (max_tokens %d, temperature %g)", config.AI.Provider, config.AI.Model, config.AI.MaxTokens, config.AI.Temperature)
+	promptHash = fmt.Sprintf("%x", sha256.Sum256([]byte(prompt)))
+
+	if err := validateProvider(config.AI.Provider); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(config.AI.Model) == "" {
+		return "", fmt.Errorf("no model configured for provider %s; set ai.model", config.AI.Provider)
+	}
+
+	// An identical prompt for the same model reuses the earlier reply
+	cacheKey := generationCacheKey(prompt)
+	reply, hit := generations.Get(cacheKey)
+	if hit {
+		debugLog("Reusing cached generation %s", cacheKey[:12])
+	} else {
+		reply, err = generateWithRetries(prompt)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if explainMode {
+		printRationale(reply)
+	}
+
+	// Render structured output through the active template
+	message := renderStructuredMessage(reply, gitInfo)
+
+	if forcedType != "" {
+		message = forceCommitType(message, forcedType)
+	}
+
+	// Verify conventional commit format if enabled, before decorations are added
+	if config.Commit.VerifyConventional && config.Commit.Style == "conventional" {
+		if err := verifyConventionalCommit(message); err != nil {
+			cache.Add(CommitRecord{
+				Message:          message,
+				Reason:           reasonVerifyFailed,
+				Provider:         config.AI.Provider,
+				Model:            config.AI.Model,
+				PromptTokens:     sessionUsage.PromptTokens,
+				CompletionTokens: sessionUsage.CompletionTokens,
+			})
+			return "", fmt.Errorf("generated message does not follow conventional commit format: %w", err)
+		}
+	}
+
+	// Only cache replies that passed verification, so a rejected one is
+	// regenerated next time
+	if !hit {
+		generations.Add(cacheKey, reply)
+	}
+
+	// Post-process the message, then hand it to any user command
+	message = postProcessCommitMessage(message, gitInfo)
+
+	return runPostProcessCommand(message)
+}
+
+var blankLinesRegex = regexp.MustCompile(`\n{3,}`)
+
+// parseStructuredMessage extracts the JSON object requested from the model,
+// tolerating surrounding prose or markdown code fences.
+func parseStructuredMessage(raw string) (*CommitTemplateData, error) {
+	start := strings.Index(raw, "{")
+	end := strings.LastIndex(raw, "}")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("no JSON object in response")
+	}
+
+	var data CommitTemplateData
+	if err := json.Unmarshal([]byte(raw[start:end+1]), &data); err != nil {
+		return nil, err
+	}
+	if data.Description == "" {
+		return nil, fmt.Errorf("response has no description")
+	}
+	return &data, nil
+}
+
+// printRationale writes the model's --explain rationale to stderr, away
+// from the message and any machine-readable stdout.
+func printRationale(raw string) {
+	data, err := parseStructuredMessage(raw)
+	if err != nil || strings.TrimSpace(data.Rationale) == "" {
+		warn.Fprintln(os.Stderr, "The model gave no rationale")
+		return
+	}
+	info.Fprintf(os.Stderr, "Rationale: %s\n", strings.Join(strings.Fields(data.Rationale), " "))
+}
+
+// renderStructuredMessage renders the model's JSON output through the active
+// template. The raw output is returned unchanged if it cannot be parsed.
+func renderStructuredMessage(raw string, gitInfo *GitInfo) string {
+	data, err := parseStructuredMessage(raw)
+	if err != nil {
+		debugLog("Using raw model output, could not parse structured response: %v", err)
+		return strings.TrimSpace(raw)
+	}
+	data.Rationale = "" // Debugging aid only, keep it out of the message
+	data.JiraTicket = gitInfo.JiraTicket
+	data.CoAuthors = config.Commit.CoAuthors
+	if data.Breaking == "" && len(gitInfo.Breaking) > 0 {
+		data.Breaking = strings.Join(gitInfo.Breaking, "; ")
+	}
+
+	templateStr, ok := config.Template.CustomTemplates[config.Template.ActiveTemplate]
+	if !ok {
+		templateStr = defaultTemplate
+	}
+	tmpl, err := template.New(config.Template.ActiveTemplate).Parse(templateStr)
+	if err != nil {
+		warn.Printf("Invalid template %q, using raw output: %v\n", config.Template.ActiveTemplate, err)
+		return strings.TrimSpace(raw)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		warn.Printf("Could not render template %q, using raw output: %v\n", config.Template.ActiveTemplate, err)
+		return strings.TrimSpace(raw)
+	}
+
+	// Tidy whitespace left behind by empty template sections
+	lines := strings.Split(buf.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(blankLinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// showSpinner reports whether to animate while waiting: only on a terminal,
+// and never with --quiet, --debug (it would garble the log) or
+// display.spinner = false.
+func showSpinner() bool {
+	if config.Display.Spinner != nil && !*config.Display.Spinner {
+		return false
+	}
+	if config.Display.Quiet || config.Display.Debug {
+		return false
+	}
+	return isatty.IsTerminal(os.Stderr.Fd()) || isatty.IsCygwinTerminal(os.Stderr.Fd())
+}
+
+// generateWithRetries sends the prompt to the configured provider, retrying
+// transient failures with backoff until system.max_retries is reached.
+func generateWithRetries(prompt string) (string, error) {
+	// system.timeout bounds the whole operation, backoff included
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
+	defer cancel()
+
+	// The spinner goes to stderr so stdout stays clean for the message
+	if showSpinner() {
+		s := spinner.New(spinner.CharSets[14], 100*time.Millisecond, spinner.WithWriterFile(os.Stderr))
+		s.Suffix = " Generating commit message..."
+		s.Start()
+		defer s.Stop()
+	}
+
+	// Always make at least one attempt
+	attempts := max(config.System.MaxRetries, 1)
+	var message string
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		// Each attempt gets an equal share of what is left, so one hung
+		// request can't use up the time meant for its retries
+		share := attemptTimeout(ctx, attempts-attempt+1)
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, share)
+		message, err = callProvider(attemptCtx, prompt)
+		attemptTimedOut := attemptCtx.Err() != nil
+		attemptCancel()
+		if err == nil {
+			return message, nil
+		}
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %ds on attempt %d: %w", config.System.Timeout, attempt, err)
+		}
+		if attemptTimedOut {
+			err = fmt.Errorf("attempt timed out after %s: %w", share.Round(100*time.Millisecond), err)
+		}
+		if !isRetryable(err) {
+			return "", err
+		}
+
+		if attempt == attempts {
+			return "", fmt.Errorf("failed after %d attempts: %w", attempts, err)
+		}
+
+		// Don't start a wait that the deadline would cut short anyway
+		delay := retryDelay(attempt, err)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			return "", fmt.Errorf("failed after %d attempts, retrying in %s would exceed the %ds timeout: %w",
+				attempt, delay.Round(100*time.Millisecond), config.System.Timeout, err)
+		}
+		warn.Printf("Attempt %d failed: %v. Retrying in %s...\n", attempt, err, delay.Round(100*time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", fmt.Errorf("timed out after %ds while waiting to retry: %w", config.System.Timeout, err)
+		}
+	}
+	return "", err
+}
+
+// attemptTimeout splits the time left before ctx's deadline evenly over the
+// attempts still to be made.
+func attemptTimeout(ctx context.Context, remaining int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining < 1 {
+		return time.Duration(config.System.Timeout) * time.Second
+	}
+	return time.Until(deadline) / time.Duration(remaining)
+}
+
+func postProcessCommitMessage(message string, gitInfo *GitInfo) string {
+	// Add JIRA ticket if enabled and not already present
+	if config.Commit.JiraIntegration && gitInfo.JiraTicket != "" {
+		if !strings.Contains(message, gitInfo.JiraTicket) {
+			subject, rest, _ := strings.Cut(message, "\n")
+			message = fmt.Sprintf("%s [%s]", subject, gitInfo.JiraTicket)
+			if rest != "" {
+				message += "\n" + rest
+			}
+		}
+	}
+
+	// Wrap only what the model wrote; the scaffold and trailers keep their lines
+	if config.Commit.WrapBody {
+		message = wrapBody(message, config.Commit.MaxLength)
+	}
+
+	// Keep the repository's scaffold, such as a checklist, above the trailers
+	if gitInfo.GitTemplate != "" && !strings.Contains(message, gitInfo.GitTemplate) {
+		message += "\n\n" + gitInfo.GitTemplate
+	}
+
+	// Collect trailers for the footer block
+	var trailers []string
+	for _, ref := range gitInfo.IssueRefs {
+		if !strings.Contains(message, "Closes "+ref) {
+			trailers = append(trailers, "Closes "+ref)
+		}
+	}
+	if config.Commit.JiraTrailer != "" && gitInfo.JiraSummary != "" {
+		trailers = append(trailers, fmt.Sprintf("%s: %s (%s)", config.Commit.JiraTrailer, gitInfo.JiraTicket, gitInfo.JiraSummary))
+	}
+	for _, trailer := range configuredFooters(message, gitInfo) {
+		if !strings.Contains(message, trailer) && !slices.Contains(trailers, trailer) {
+			trailers = append(trailers, trailer)
+		}
+	}
+	for _, author := range config.Commit.CoAuthors {
+		trailer := fmt.Sprintf("Co-authored-by: %s", author)
+		if !strings.Contains(message, trailer) {
+			trailers = append(trailers, trailer)
+		}
+	}
+	for _, trailer := range gitInfo.Trailers {
+		if !strings.Contains(message, trailer) && !slices.Contains(trailers, trailer) {
+			trailers = append(trailers, trailer)
+		}
+	}
+	if len(trailers) > 0 {
+		message += "\n\n" + strings.Join(trailers, "\n")
+	}
+
+	// Add emojis if enabled
+	if config.Commit.EmojisEnabled {
+		message = addCommitEmojis(message)
+	}
+
+	lines := strings.Split(message, "\n")
+	lines[0] = wrapSubject(lines[0], gitInfo)
+	message = strings.Join(lines, "\n")
+
+	// Cutting the subject short would lose meaning, so only flag it
+	if limit := config.Commit.SubjectMaxLength; limit > 0 {
+		if length := utf8.RuneCountInString(lines[0]); length > limit {
+			warn.Printf("Subject is %d characters, over the %d character limit\n", length, limit)
+		}
+	}
+
+	return message
+}
+
+// footerRegex splits a commit.footers entry into its key, separator and
+// value template.
+var footerRegex = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*)(: | #)(.*)$`)
+
+// configuredFooters expands commit.footers against the message, so
+// "Refs: {{.JiraTicket}}" picks up the ticket from the branch. Footers whose
+// value expands to nothing are left out.
+func configuredFooters(message string, gitInfo *GitInfo) []string {
+	if len(config.Commit.Footers) == 0 {
+		return nil
+	}
+
+	data, _ := parseConventionalCommit(message)
+	data.Body = splitCommitMessage(message).Body
+	data.JiraTicket = gitInfo.JiraTicket
+	data.CoAuthors = config.Commit.CoAuthors
+
+	var footers []string
+	for _, footer := range config.Commit.Footers {
+		match := footerRegex.FindStringSubmatch(strings.TrimSpace(footer))
+		if match == nil {
+			warn.Printf("Skipping commit.footers entry %q: expected \"Key: value\"\n", footer)
+			continue
+		}
+		tmpl, err := template.New(match[1]).Parse(match[3])
+		if err != nil {
+			warn.Printf("Skipping commit.footers entry %q: %v\n", footer, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			warn.Printf("Skipping commit.footers entry %q: %v\n", footer, err)
+			continue
+		}
+		// A trailer has to stay on one line
+		value := strings.Join(strings.Fields(buf.String()), " ")
+		if value == "" {
+			continue
+		}
+		footers = append(footers, match[1]+match[2]+value)
+	}
+	return footers
+}
+
+// wrapBody hard-wraps the prose paragraphs of a message body at width
+// columns. The subject, code blocks, list items, indented lines and footer
+// paragraphs (trailers or BREAKING CHANGE) are left untouched.
+func wrapBody(message string, width int) string {
+	if width <= 0 {
+		width = 72
+	}
+	lines := strings.Split(message, "\n")
+	if len(lines) < 2 {
+		return message
+	}
+
+	// Group the body into paragraphs, keeping fenced code blocks whole even
+	// when they contain blank lines
+	var paragraphs [][]string
+	var current []string
+	inFence := false
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inFence = !inFence
+		}
+		if strings.TrimSpace(line) == "" && !inFence {
+			if current != nil {
+				paragraphs = append(paragraphs, current)
+				current = nil
+			}
+			paragraphs = append(paragraphs, nil)
+			continue
+		}
+		current = append(current, line)
+	}
+	if current != nil {
+		paragraphs = append(paragraphs, current)
+	}
+
+	out := []string{lines[0]}
+	for _, paragraph := range paragraphs {
+		if paragraph == nil {
+			out = append(out, "")
+			continue
+		}
+		if isFooterParagraph(paragraph) {
+			out = append(out, paragraph...)
+			continue
+		}
+
+		var prose []string
+		flush := func() {
+			if prose != nil {
+				out = append(out, wrapText(strings.Join(prose, " "), width)...)
+				prose = nil
+			}
+		}
+		inFence = false
+		for _, line := range paragraph {
+			fence := strings.HasPrefix(strings.TrimSpace(line), "```")
+			if inFence || fence || isListItem(line) || strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t") {
+				flush()
+				out = append(out, line)
+				if fence {
+					inFence = !inFence
+				}
+				continue
+			}
+			prose = append(prose, strings.TrimSpace(line))
+		}
+		flush()
+	}
+	return strings.Join(out, "\n")
+}
+
+// isFooterParagraph reports whether a paragraph is a git trailer block or a
+// BREAKING CHANGE footer, both of which must keep their line structure.
+func isFooterParagraph(paragraph []string) bool {
+	first := strings.TrimSpace(paragraph[0])
+	if strings.HasPrefix(first, "BREAKING CHANGE:") || strings.HasPrefix(first, "BREAKING-CHANGE:") {
+		return true
+	}
+	for _, line := range paragraph {
+		if !trailerRegex.MatchString(strings.TrimSpace(line)) {
+			return false
+		}
+	}
+	return true
+}
+
+var listItemRegex = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s`)
+
+func isListItem(line string) bool {
+	return listItemRegex.MatchString(line)
+}
+
+// wrapText greedily fills lines up to width runes. Words longer than width,
+// such as URLs, get a line of their own rather than being split.
+func wrapText(text string, width int) []string {
+	var lines []string
+	var line strings.Builder
+	lineLen := 0
+	for _, word := range strings.Fields(text) {
+		wordLen := utf8.RuneCountInString(word)
+		if lineLen > 0 && lineLen+1+wordLen > width {
+			lines = append(lines, line.String())
+			line.Reset()
+			lineLen = 0
+		}
+		if lineLen > 0 {
+			line.WriteByte(' ')
+			lineLen++
+		}
+		line.WriteString(word)
+		lineLen += wordLen
+	}
+	if lineLen > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// SubjectTemplateData is available to the subject prefix and suffix templates.
+type SubjectTemplateData struct {
+	Date       string
+	Branch     string
+	JiraTicket string
+}
+
+// wrapSubject applies the configured subject prefix and suffix templates.
+func wrapSubject(subject string, gitInfo *GitInfo) string {
+	if config.Commit.SubjectPrefix == "" && config.Commit.SubjectSuffix == "" {
+		return subject
+	}
+
+	data := SubjectTemplateData{
+		Date:       time.Now().Format("2006-01-02"),
+		Branch:     gitInfo.Branch,
+		JiraTicket: gitInfo.JiraTicket,
+	}
+	return renderSubjectTemplate(config.Commit.SubjectPrefix, data) +
+		subject +
+		renderSubjectTemplate(config.Commit.SubjectSuffix, data)
+}
+
+func renderSubjectTemplate(text string, data SubjectTemplateData) string {
+	if text == "" {
+		return ""
+	}
+	tmpl, err := template.New("subject").Parse(text)
+	if err != nil {
+		warn.Printf("Invalid subject template %q: %v\n", text, err)
+		return text
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		warn.Printf("Could not render subject template %q: %v\n", text, err)
+		return text
+	}
+	return buf.String()
+}
+
+// languageNames maps common ISO 639-1 codes to the names the model is
+// given for commit.language.
+var languageNames = map[string]string{
+	"ar": "Arabic", "cs": "Czech", "da": "Danish", "de": "German", "el": "Greek",
+	"en": "English", "es": "Spanish", "fi": "Finnish", "fr": "French", "he": "Hebrew",
+	"hi": "Hindi", "hu": "Hungarian", "id": "Indonesian", "it": "Italian", "ja": "Japanese",
+	"ko": "Korean", "nl": "Dutch", "no": "Norwegian", "pl": "Polish", "pt": "Portuguese",
+	"ro": "Romanian", "ru": "Russian", "sv": "Swedish", "th": "Thai", "tr": "Turkish",
+	"uk": "Ukrainian", "vi": "Vietnamese", "zh": "Chinese",
+}
+
+// messageLanguage returns commit.language as a language name, so an ISO
+// code like "fr" becomes "French". Other values are used as given.
+func messageLanguage(cfg *Config) string {
+	language := strings.TrimSpace(cfg.Commit.Language)
+	if name, ok := languageNames[strings.ToLower(language)]; ok {
+		return name
+	}
+	return language
+}
+
+// PromptTemplateData is what ai.prompt_template is rendered with.
+type PromptTemplateData struct {
+	Git    *GitInfo
+	Config *Config
+}
+
+// parsePromptTemplate parses an ai.prompt_template. Besides the standard
+// functions, templates can use join to list values such as the types.
+func parsePromptTemplate(text string) (*template.Template, error) {
+	return template.New("prompt").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+// renderPromptRules renders ai.prompt_template, falling back to the built-in
+// rules when it is empty or broken. The error reports why a template set by
+// the user was not used.
+func renderPromptRules(gitInfo *GitInfo, cfg *Config) (string, error) {
+	data := PromptTemplateData{Git: gitInfo, Config: cfg}
+	var renderErr error
+	if text := cfg.AI.PromptTemplate; text != "" {
+		var buf bytes.Buffer
+		tmpl, err := parsePromptTemplate(text)
+		if err == nil {
+			err = tmpl.Execute(&buf, data)
+		}
+		if err == nil {
+			return buf.String(), nil
+		}
+		renderErr = err
+	}
+
+	var buf bytes.Buffer
+	template.Must(parsePromptTemplate(defaultPromptTemplate)).Execute(&buf, data)
+	return buf.String(), renderErr
+}
+
+var trailerRegex = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*|BREAKING CHANGE)(: | #).+`)
+
+// splitCommitMessage splits a message into subject, body and trailers. The
+// trailers are the final paragraph when every line in it is a "Key: value" pair.
+func splitCommitMessage(message string) MessageParts {
+	lines := strings.Split(strings.TrimSpace(message), "\n")
+	parts := MessageParts{Subject: strings.TrimSpace(lines[0]), Trailers: []string{}}
+	rest := lines[1:]
+
+	// Find the start of the last paragraph
+	start := len(rest)
+	for start > 0 && strings.TrimSpace(rest[start-1]) != "" {
+		start--
+	}
+
+	// The subject itself is never a trailer block
+	isTrailers := start > 0 && start < len(rest)
+	for _, line := range rest[start:] {
+		if !trailerRegex.MatchString(strings.TrimSpace(line)) {
+			isTrailers = false
+			break
+		}
+	}
+	if isTrailers {
+		for _, line := range rest[start:] {
+			parts.Trailers = append(parts.Trailers, strings.TrimSpace(line))
+		}
+		rest = rest[:start]
+	}
+
+	parts.Body = strings.TrimSpace(strings.Join(rest, "\n"))
+	return parts
+}
+
+// buildJSONOutput assembles the structured preview of a generated message.
+func buildJSONOutput(message string, gitInfo *GitInfo) JSONOutput {
+	parts := splitCommitMessage(message)
+	out := JSONOutput{
+		SchemaVersion: jsonSchemaVersion,
+		Message:       message,
+		Subject:       parts.Subject,
+		Body:          parts.Body,
+		Trailers:      parts.Trailers,
+		Files:         []JSONFile{},
+	}
+	for _, file := range gitInfo.Files {
+		out.Files = append(out.Files, JSONFile{
+			Path:      file.Path,
+			OldPath:   file.OldPath,
+			Status:    file.Status,
+			Additions: file.Addition,
+			Deletions: file.Deletion,
+			Binary:    file.IsBinary,
+			Language:  file.Language,
+		})
+	}
+	out.Stats.Files = len(gitInfo.Files)
+	out.Stats.Additions = gitInfo.TotalChanges.Additions
+	out.Stats.Deletions = gitInfo.TotalChanges.Deletions
+	out.Jira = gitInfo.JiraTicket
+	out.Provider = config.AI.Provider
+	out.Model = config.AI.Model
+	return out
+}
+
+// conventionalSubjectRegex splits a subject into type, scope, the breaking
+// "!" marker and description.
+var conventionalSubjectRegex = regexp.MustCompile(`^(\w+)(?:\(([^)]+)\))?(!)?: (.+)$`)
+
+// stripLeadingEmoji removes an emoji prefix such as the one commit.emojis
+// adds, so "✨ feat: add login" reads as "feat: add login".
+func stripLeadingEmoji(subject string) string {
+	first, _ := utf8.DecodeRuneInString(subject)
+	if first < utf8.RuneSelf || unicode.IsLetter(first) || unicode.IsDigit(first) {
+		return subject
+	}
+	// Emoji can be several code points, with variation selectors and joiners
+	rest := strings.TrimLeftFunc(subject, func(r rune) bool {
+		return r >= utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	})
+	return strings.TrimLeft(rest, " ")
+}
+
+// parseConventionalCommit extracts the conventional parts of a commit
+// message. Breaking is the BREAKING CHANGE footer text, or the description
+// when only the "!" marker is present.
+func parseConventionalCommit(message string) (CommitTemplateData, bool) {
+	subject, rest, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	match := conventionalSubjectRegex.FindStringSubmatch(stripLeadingEmoji(strings.TrimSpace(subject)))
+	if match == nil {
+		return CommitTemplateData{}, false
+	}
+	data := CommitTemplateData{
+		Type:        strings.ToLower(match[1]),
+		Scope:       match[2],
+		Description: match[4],
+	}
+
+	// A footer paragraph runs until the next blank line
+	var footer []string
+	inFooter := false
+	for _, line := range strings.Split(rest, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !inFooter {
+			for _, key := range []string{"BREAKING CHANGE:", "BREAKING-CHANGE:"} {
+				if strings.HasPrefix(trimmed, key) {
+					inFooter = true
+					trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, key))
+				}
+			}
+			if inFooter && trimmed != "" {
+				footer = append(footer, trimmed)
+			}
+			continue
+		}
+		if trimmed == "" {
+			break
+		}
+		footer = append(footer, trimmed)
+	}
+	data.Breaking = strings.Join(footer, " ")
+	if data.Breaking == "" && match[3] == "!" {
+		data.Breaking = data.Description
+	}
+	return data, true
+}
+
+// verifyConventionalCommit checks a message against the allowed types, the
+// scope rules and [commit.rules]. Subjects go through parseConventionalCommit,
+// so a "!" breaking marker and a leading emoji are accepted.
+func verifyConventionalCommit(message string) error {
+	data, ok := parseConventionalCommit(message)
+	if !ok || !slices.ContainsFunc(config.Commit.ScopePrefix, func(typ string) bool {
+		return strings.EqualFold(typ, data.Type)
+	}) || (data.Scope != "" && !config.Commit.IncludeScope) {
+		return fmt.Errorf("message does not match conventional commit format")
+	}
+
+	if data.Scope != "" {
+		if err := validateScope(data.Scope, &config); err != nil {
+			return err
+		}
+	}
+	return checkCommitRules(message)
+}
+
+// checkCommitRules applies the [commit.rules] checks. Errors name the rule
+// so it can be switched off if a team disagrees with it.
+func checkCommitRules(message string) error {
+	rules := config.Commit.Rules
+	lines := strings.Split(message, "\n")
+	subject := lines[0]
+
+	if rules.NoTrailingPeriod && strings.HasSuffix(strings.TrimSpace(subject), ".") {
+		return fmt.Errorf("rule no_trailing_period: subject must not end with a period")
+	}
+
+	if rules.SubjectCase != "" {
+		_, description, _ := strings.Cut(subject, ": ")
+		if first, _ := utf8.DecodeRuneInString(strings.TrimSpace(description)); unicode.IsLetter(first) {
+			switch rules.SubjectCase {
+			case "lower":
+				if !unicode.IsLower(first) {
+					return fmt.Errorf("rule subject_case: description must start with a lowercase letter")
+				}
+			case "upper":
+				if !unicode.IsUpper(first) {
+					return fmt.Errorf("rule subject_case: description must start with an uppercase letter")
+				}
+			default:
+				return fmt.Errorf("rule subject_case: unknown case %q (supported: lower, upper)", rules.SubjectCase)
+			}
+		}
+	}
+
+	if limit := config.Commit.SubjectMaxLength; rules.SubjectLength && limit > 0 {
+		if length := utf8.RuneCountInString(subject); length > limit {
+			return fmt.Errorf("rule subject_length: subject is %d characters, over the %d character limit", length, limit)
+		}
+	}
+
+	if rules.BlankLineBeforeBody && len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
+		return fmt.Errorf("rule blank_line_before_body: the body must be separated from the subject by an empty line")
+	}
+	return nil
+}
+
+var scopeSegmentRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// validateScope checks that a scope is well formed and, when allowed_scopes
+// is set, matches one of its entries. Scopes may be hierarchical, so "web/auth"
+// matches "web/*", and "web/**" matches any depth below "web".
+func validateScope(scope string, cfg *Config) error {
+	for _, segment := range strings.Split(scope, "/") {
+		if !scopeSegmentRegex.MatchString(segment) {
+			return fmt.Errorf("invalid scope %q: segments must be non-empty and contain only letters, digits, '.', '_' or '-'", scope)
+		}
+	}
+
+	if len(cfg.Commit.AllowedScopes) == 0 {
+		return nil
+	}
+	for _, allowed := range cfg.Commit.AllowedScopes {
+		if matchScope(allowed, scope) {
+			return nil
+		}
+	}
+	return fmt.Errorf("scope %q is not allowed (allowed: %s)", scope, strings.Join(cfg.Commit.AllowedScopes, ", "))
+}
+
+// matchScope matches a scope against an allowed pattern. "*" matches a single
+// path segment and a trailing "/**" matches the prefix and anything below it.
+func matchScope(pattern, scope string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return scope == prefix || strings.HasPrefix(scope, prefix+"/")
+	}
+	matched, err := path.Match(pattern, scope)
+	return err == nil && matched
+}
+
+var conventionalEmojis = map[string]string{
+	"feat":     "✨",
+	"fix":      "🐛",
+	"docs":     "📚",
+	"style":    "💎",
+	"refactor": "♻️",
+	"test":     "🧪",
+	"chore":    "🔧",
+}
+
+// gitmojiEmojis is the gitmoji set keyed by commit type. See https://gitmoji.dev.
+var gitmojiEmojis = map[string]string{
+	"feat":      "✨",
+	"fix":       "🐛",
+	"hotfix":    "🚑️",
+	"docs":      "📝",
+	"style":     "🎨",
+	"refactor":  "♻️",
+	"perf":      "⚡️",
+	"test":      "✅",
+	"build":     "👷",
+	"ci":        "💚",
+	"chore":     "🔧",
+	"config":    "🔧",
+	"security":  "🔒️",
+	"deps":      "⬆️",
+	"upgrade":   "⬆️",
+	"downgrade": "⬇️",
+	"revert":    "⏪️",
+	"release":   "🔖",
+	"init":      "🎉",
+	"remove":    "🔥",
+	"wip":       "🚧",
+	"i18n":      "🌐",
+	"a11y":      "♿️",
+	"typo":      "✏️",
+	"ui":        "💄",
+	"breaking":  "💥",
+	"lint":      "🚨",
+	"move":      "🚚",
+	"license":   "📄",
+	"db":        "🗃️",
+	"log":       "🔊",
+	"types":     "🏷️",
+	"merge":     "🔀",
+	"analytics": "📈",
+}
+
+var commitTypeRegex = regexp.MustCompile(`^(\w+)(\([^)]+\))?!?:`)
+
+// addCommitEmojis prefixes the subject with the emoji for its commit type,
+// using the table selected by commit.emoji_style.
+func addCommitEmojis(message string) string {
+	emojiMap := conventionalEmojis
+	if config.Commit.EmojiStyle == "gitmoji" {
+		emojiMap = gitmojiEmojis
+	}
+
+	match := commitTypeRegex.FindStringSubmatch(message)
+	if match == nil {
+		return message
+	}
+	emoji, ok := emojiMap[strings.ToLower(match[1])]
+	if !ok {
+		return message
+	}
+	return emoji + " " + message
+}
+
+// retryAfterError carries a delay requested by the server, e.g. via a
+// Retry-After header on a 429 response.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// retryDelay returns how long to wait before the next attempt: the server's
+// Retry-After if given, otherwise retry_delay * 2^(attempt-1) capped at
+// max_retry_delay, with jitter so concurrent clients don't retry in lockstep.
+func retryDelay(attempt int, err error) time.Duration {
+	var retryAfter *retryAfterError
+	if errors.As(err, &retryAfter) && retryAfter.delay > 0 {
+		return retryAfter.delay
+	}
+
+	base := time.Duration(config.System.RetryDelay) * time.Second
+	delay := base << (attempt - 1)
+	if limit := time.Duration(config.System.MaxRetryDelay) * time.Second; limit > 0 && (delay > limit || delay < base) {
+		delay = limit
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	// Equal jitter: wait between half and all of the computed delay
+	half := delay / 2
+	return half + time.Duration(rand.Int64N(int64(delay-half)+1))
+}
+
+// retryAfterTransport records the Retry-After header of 429 and 503
+// responses, which the OpenAI client library does not expose on its errors.
+type retryAfterTransport struct {
+	base       http.RoundTripper
+	retryAfter time.Duration
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && honorsRetryAfter(resp.StatusCode) {
+		t.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return resp, err
+}
+
+// honorsRetryAfter reports whether a server's Retry-After is used for a
+// response with this status: rate limits and temporary unavailability.
+func honorsRetryAfter(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// responseError wraps err with the status of a failed provider response,
+// carrying any Retry-After delay so every provider backs off the same way.
+func responseError(resp *http.Response, err error) error {
+	err = &statusError{resp.StatusCode, err}
+	if honorsRetryAfter(resp.StatusCode) {
+		if delay := parseRetryAfter(resp.Header.Get("Retry-After")); delay > 0 {
+			return &retryAfterError{err: err, delay: delay}
+		}
+	}
+	return err
+}
+
+// parseRetryAfter accepts both forms of the header: delay seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// statusError records the HTTP status of a failed provider request.
+type statusError struct {
+	StatusCode int
+	err        error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+// permanentError marks a failure that retrying cannot fix, such as a
+// missing API key.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// isRetryable reports whether a provider error is transient. Rate limits,
+// server errors, timeouts and network failures are retried; bad requests,
+// authentication failures and configuration problems fail fast.
+func isRetryable(err error) bool {
+	var permanent *permanentError
+	if errors.As(err, &permanent) || errors.Is(err, errRetryBudgetExhausted) {
+		return false
+	}
+
+	status := 0
+	var se *statusError
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	switch {
+	case errors.As(err, &se):
+		status = se.StatusCode
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		status = reqErr.HTTPStatusCode
+	}
+	if status == 0 {
+		// Timeouts, network errors and malformed responses
+		return true
+	}
+	return status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500
+}
+
+// callProvider makes a single attempt against the configured provider. Every
+// provider call goes through here so system.max_total_retries bounds the
+// total number of attempts made by the whole command.
+func callProvider(ctx context.Context, prompt string) (string, error) {
+	if config.System.MaxTotalRetries > 0 && providerCalls >= config.System.MaxTotalRetries {
+		return "", fmt.Errorf("%w after %d attempts", errRetryBudgetExhausted, providerCalls)
+	}
+	providerCalls++
+
+	var message string
+	var usage TokenUsage
+	var err error
+	switch config.AI.Provider {
+	case "openai":
+		message, usage, err = generateWithOpenAI(ctx, prompt)
+	case "ollama":
+		message, usage, err = generateWithOllama(ctx, prompt)
+	case "gemini":
+		message, usage, err = generateWithGemini(ctx, prompt)
+	default:
+		return "", &permanentError{fmt.Errorf("unsupported provider: %s", config.AI.Provider)}
+	}
+	sessionUsage.PromptTokens += usage.PromptTokens
+	sessionUsage.CompletionTokens += usage.CompletionTokens
+	// Record spend per call so every command and retry is counted
+	if usage.PromptTokens > 0 || usage.CompletionTokens > 0 {
+		ledger.Add(usage, estimateCost(usage))
+	}
+	return message, err
+}
+
+// shellCommand runs command through the platform shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// runFilterCommand pipes input through the shell command configured under
+// key and returns its trimmed stdout. It is bounded by system.timeout, and a
+// failure reports the command's stderr.
+func runFilterCommand(key, command, input string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	filterCmd := shellCommand(ctx, command)
+	filterCmd.Stdin = strings.NewReader(input)
+	filterCmd.Stdout = &stdout
+	filterCmd.Stderr = &stderr
+	// Don't wait on children that outlive a killed shell and hold its pipes
+	filterCmd.WaitDelay = time.Second
+	if err := filterCmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("%s timed out after %ds", key, config.System.Timeout)
+		}
+		if detail := strings.TrimSpace(stderr.String()); detail != "" {
+			return "", fmt.Errorf("%s failed: %w\n%s", key, err, detail)
+		}
+		return "", fmt.Errorf("%s failed: %w", key, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// runPostProcessCommand passes the message through commit.post_process_command,
+// if one is set.
+func runPostProcessCommand(message string) (string, error) {
+	command := config.Commit.PostProcessCommand
+	if command == "" {
+		return message, nil
+	}
+	output, err := runFilterCommand("commit.post_process_command", command, message+"\n")
+	if err != nil {
+		return "", err
+	}
+	if output == "" {
+		return "", fmt.Errorf("commit.post_process_command printed no message")
+	}
+	debugLog("commit.post_process_command rewrote the message:\n%s", output)
+	return output, nil
+}
+
+// openAIKey resolves the API key from ai.openai.key_command, then
+// ai.openai.key_file, then the api_key_env and OPENAI_API_KEY variables.
+func openAIKey() (string, error) {
+	if command := config.AI.OpenAI.KeyCommand; command != "" {
+		keyCmd := shellCommand(context.Background(), command)
+		keyCmd.Stderr = os.Stderr
+		output, err := keyCmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running ai.openai.key_command: %w", err)
+		}
+		if key := strings.TrimSpace(string(output)); key != "" {
+			return key, nil
+		}
+		return "", fmt.Errorf("ai.openai.key_command printed no key")
+	}
+	if path := config.AI.OpenAI.KeyFile; path != "" {
+		if rest, ok := strings.CutPrefix(path, "~/"); ok {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, rest)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("error reading ai.openai.key_file: %w", err)
+		}
+		if key := strings.TrimSpace(string(data)); key != "" {
+			return key, nil
+		}
+		return "", fmt.Errorf("ai.openai.key_file %s is empty", path)
+	}
+
+	if name := config.AI.OpenAI.APIKeyEnv; name != "" {
+		if key := strings.TrimSpace(os.Getenv(name)); key != "" {
+			return key, nil
+		}
+	}
+	if key := strings.TrimSpace(os.Getenv("OPENAI_API_KEY")); key != "" {
+		return key, nil
+	}
+	if name := config.AI.OpenAI.APIKeyEnv; name != "" && name != "OPENAI_API_KEY" {
+		return "", fmt.Errorf("neither %s nor OPENAI_API_KEY environment variable is set", name)
+	}
+	return "", fmt.Errorf("OPENAI_API_KEY environment variable not set")
+}
+
+// openAIBaseURL returns the endpoint for OpenAI-compatible hosts. The
+// OPENAI_BASE_URL environment variable overrides ai.openai.base_url.
+func openAIBaseURL() string {
+	if baseURL := os.Getenv("OPENAI_BASE_URL"); baseURL != "" {
+		return baseURL
+	}
+	return config.AI.OpenAI.BaseURL
+}
+
+func generateWithOpenAI(ctx context.Context, prompt string) (string, TokenUsage, error) {
+	apiKey, err := openAIKey()
+	if err != nil {
+		return "", TokenUsage{}, &permanentError{err}
+	}
+
+	transport := &retryAfterTransport{base: newTransport()}
+	clientConfig := openai.DefaultConfig(apiKey)
+	clientConfig.HTTPClient = &http.Client{Transport: transport}
+	if baseURL := openAIBaseURL(); baseURL != "" {
+		clientConfig.BaseURL = strings.TrimRight(baseURL, "/")
+	}
+	client := openai.NewClientWithConfig(clientConfig)
+	resp, err := client.CreateChatCompletion(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model: config.AI.Model,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: prompt,
+				},
+			},
+			MaxTokens:   config.AI.MaxTokens,
+			Temperature: config.AI.Temperature,
+		},
+	)
+
+	if err != nil {
+		err = fmt.Errorf("error generating with OpenAI: %w", err)
+		if transport.retryAfter > 0 {
+			err = &retryAfterError{err: err, delay: transport.retryAfter}
+		}
+		return "", TokenUsage{}, err
+	}
+
+	usage := TokenUsage{
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	// Compatible hosts don't always honor the contract
+	if len(resp.Choices) == 0 {
+		return "", usage, fmt.Errorf("error generating with OpenAI: response has no choices")
+	}
+	return resp.Choices[0].Message.Content, usage, nil
+}
+
+// newTransport returns the base transport for every outgoing request, so all
+// providers and the JIRA lookup go through the same proxy settings.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc()
+	return transport
+}
+
+// proxyFunc uses system.proxy when set and otherwise honors HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY.
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	if config.System.Proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := url.Parse(config.System.Proxy)
+	if err != nil || proxyURL.Host == "" {
+		return func(*http.Request) (*url.URL, error) {
+			return nil, &permanentError{fmt.Errorf("invalid system.proxy %q", config.System.Proxy)}
+		}
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// newOllamaClient returns an HTTP client whose transport gives up on a server
+// that accepts connections but never answers. Ollama only sends headers once
+// the whole reply is generated, so the header timeout matches system.timeout;
+// body reads are still bounded by the request context.
+func newOllamaClient() *http.Client {
+	timeout := time.Duration(config.System.Timeout) * time.Second
+	dialTimeout := 5 * time.Second
+	if timeout > 0 && timeout < dialTimeout {
+		dialTimeout = timeout
+	}
+	transport := newTransport()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout}).DialContext
+	transport.TLSHandshakeTimeout = dialTimeout
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: transport}
+}
+
+func generateWithOllama(ctx context.Context, prompt string) (string, TokenUsage, error) {
+	reqBody := OllamaRequest{
+		Model: config.AI.Model,
+		Messages: []Message{
+			{
+				Role:    "user",
+				Content: prompt,
+			},
+		},
+		Options: OllamaOptions{
+			Temperature: config.AI.Temperature,
+			NumPredict:  config.AI.MaxTokens,
+		},
+	}
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", config.AI.Ollama.URL, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := newOllamaClient().Do(req)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error making request to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error reading response: %w", err)
+	}
+
+	var ollamaResp OllamaResponse
+	if err := json.Unmarshal(body, &ollamaResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Ollama: %s", resp.Status))
+		}
+		return "", TokenUsage{}, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if ollamaResp.Error != "" {
+		return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Ollama: %s", ollamaResp.Error))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Ollama: %s", resp.Status))
+	}
+	if strings.TrimSpace(ollamaResp.Message.Content) == "" {
+		return "", TokenUsage{}, fmt.Errorf("error generating with Ollama: empty response")
+	}
+
+	usage := TokenUsage{
+		PromptTokens:     ollamaResp.PromptEvalCount,
+		CompletionTokens: ollamaResp.EvalCount,
+	}
+	return ollamaResp.Message.Content, usage, nil
+}
+
+const geminiBaseURL = "https://generativelanguage.googleapis.com/v1beta/models/"
+
+type GeminiRequest struct {
+	Contents         []GeminiContent `json:"contents"`
+	GenerationConfig struct {
+		Temperature     float32 `json:"temperature"`
+		MaxOutputTokens int     `json:"maxOutputTokens,omitempty"`
+	} `json:"generationConfig"`
+}
+
+type GeminiContent struct {
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiPart struct {
+	Text string `json:"text"`
+}
+
+type GeminiResponse struct {
+	Candidates []struct {
+		Content GeminiContent `json:"content"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func generateWithGemini(ctx context.Context, prompt string) (string, TokenUsage, error) {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		return "", TokenUsage{}, &permanentError{fmt.Errorf("GEMINI_API_KEY environment variable not set")}
+	}
+
+	reqBody := GeminiRequest{
+		Contents: []GeminiContent{{Parts: []GeminiPart{{Text: prompt}}}},
+	}
+	reqBody.GenerationConfig.Temperature = config.AI.Temperature
+	reqBody.GenerationConfig.MaxOutputTokens = config.AI.MaxTokens
+
+	jsonBody, err := json.Marshal(reqBody)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	url := geminiBaseURL + config.AI.Model + ":generateContent"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", apiKey)
+
+	client := &http.Client{Transport: newTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error making request to Gemini: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", TokenUsage{}, fmt.Errorf("error reading response: %w", err)
+	}
+
+	var geminiResp GeminiResponse
+	if err := json.Unmarshal(body, &geminiResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Gemini: %s", resp.Status))
+		}
+		return "", TokenUsage{}, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if geminiResp.Error != nil {
+		return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Gemini: %s", geminiResp.Error.Message))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", TokenUsage{}, responseError(resp, fmt.Errorf("error generating with Gemini: %s", resp.Status))
+	}
+	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
+		return "", TokenUsage{}, fmt.Errorf("error generating with Gemini: empty response")
+	}
+
+	usage := TokenUsage{
+		PromptTokens:     geminiResp.UsageMetadata.PromptTokenCount,
+		CompletionTokens: geminiResp.UsageMetadata.CandidatesTokenCount,
+	}
+	return geminiResp.Candidates[0].Content.Parts[0].Text, usage, nil
+}
+
+func main() {
+	var rootCmd = &cobra.Command{
+		Use:   "zing",
+		Short: "AI-powered commit message generator",
+		Long: `Zing is a smart commit message generator that uses AI to create
+meaningful commit messages based on your staged changes.
+
+It supports both OpenAI and Ollama as AI providers and can generate
+messages in conventional commits format or detailed style.
+
+Pass file paths to commit only those staged files.`,
+		Args: cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			// Restrict the commit to the requested paths
+			paths := args
+
+			// As a hook, git passes the message file, the source and a sha
+			messageFile, _ := cmd.Flags().GetString("message-file")
+			hookMode, _ := cmd.Flags().GetString("hook-mode")
+			if hookMode != "" {
+				if hookMode != "prepare-commit-msg" {
+					return fmt.Errorf("unsupported --hook-mode %q (supported: prepare-commit-msg)", hookMode)
+				}
+				if len(args) == 0 {
+					return fmt.Errorf("--hook-mode prepare-commit-msg needs the message file passed by git")
+				}
+				messageFile, paths = args[0], nil
+				if len(args) > 1 && skipHookSource(args[1]) {
+					debugLog("Not generating for a %s commit", args[1])
+					return nil
+				}
+				defer func() {
+					// A failing hook aborts the commit; leave the message to the user instead
+					if err != nil {
+						warn.Fprintf(os.Stderr, "zing: %v\n", err)
+						err = nil
+					}
+				}()
+			}
+
+			if interactive, _ := cmd.Flags().GetBool("interactive"); interactive && hookMode == "" {
+				if err := stageInteractively(); err != nil {
+					return err
+				}
+			}
+
+			gitInfo, err := stagedGitInfo(paths)
+			if err != nil {
+				return err
+			}
+
+			if err := applyGenerationFlags(cmd); err != nil {
+				return err
+			}
+			gitInfo.Context, _ = cmd.Flags().GetString("context")
+
+			outputFormat, _ := cmd.Flags().GetString("output")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			if shorthand, _ := cmd.Flags().GetBool("json"); shorthand {
+				outputFormat = "json"
+				dryRun = true
+			}
+			switch outputFormat {
+			case "text":
+			case "json":
+				autoConfirm, _ := cmd.Flags().GetBool("yes")
+				if !dryRun && !autoConfirm {
+					return fmt.Errorf("--output json cannot prompt for confirmation; pass --yes or --dry-run")
+				}
+				// Warnings and progress still reach the user on stderr
+				jsonMode = true
+				color.Output = os.Stderr
+				applyColor()
+			default:
+				return fmt.Errorf("unknown output format %q (supported: text, json)", outputFormat)
+			}
+
+			noVerify, _ := cmd.Flags().GetBool("no-verify")
+			if noVerify {
+				config.Commit.VerifyConventional = false
+			}
+			coAuthors, _ := cmd.Flags().GetStringArray("co-author")
+			for _, author := range coAuthors {
+				if !coAuthorRegex.MatchString(strings.TrimSpace(author)) {
+					return fmt.Errorf("invalid --co-author %q: expected \"Name <email>\"", author)
+				}
+			}
+			if only, _ := cmd.Flags().GetBool("co-author-only"); only {
+				config.Commit.CoAuthors = validCoAuthors(coAuthors)
+			} else {
+				config.Commit.CoAuthors = validCoAuthors(append(config.Commit.CoAuthors, coAuthors...))
+			}
+			trailers, _ := cmd.Flags().GetStringArray("trailer")
+			for _, trailer := range trailers {
+				trailer = strings.TrimSpace(trailer)
+				if !trailerRegex.MatchString(trailer) {
+					return fmt.Errorf("invalid --trailer %q: expected \"Key: value\"", trailer)
+				}
+				gitInfo.Trailers = append(gitInfo.Trailers, trailer)
+			}
+			if signoff, _ := cmd.Flags().GetBool("signoff"); signoff || config.Commit.Signoff {
+				trailer, err := signoffTrailer()
+				if err != nil {
+					return err
+				}
+				gitInfo.Trailers = append(gitInfo.Trailers, trailer)
+			}
+
+			// Check signing before paying for a generation that can't be committed
+			signConfig, err := commitSigningConfig()
+			if err != nil {
+				return err
+			}
+
+			if noCacheWrite, _ := cmd.Flags().GetBool("no-cache-write"); noCacheWrite {
+				cache.ReadOnly = true
+			}
+
+			if !config.Display.Quiet && !jsonMode {
+				info.Printf("Found %d staged files", len(gitInfo.Files))
+				fmt.Println("Changes summary:")
+				for _, file := range gitInfo.Files {
+					if file.IsBinary {
+						fmt.Printf("  %s: %s (binary file)\n", file.Status, file.Path)
+					} else {
+						fmt.Printf("  %s: %s (+%d/-%d)\n", file.Status, file.Path, file.Addition, file.Deletion)
+					}
+				}
+			}
+
+			started := time.Now()
+			message, err := generateCommitMessage(gitInfo)
+			if err != nil {
+				return fmt.Errorf("error generating commit message: %w", err)
+			}
+			generationTime := time.Since(started)
+
+			// Report token usage; callProvider has already recorded it
+			if sessionUsage.PromptTokens > 0 || sessionUsage.CompletionTokens > 0 {
+				cost := estimateCost(sessionUsage)
+				if !config.Display.Quiet && !jsonMode {
+					info.Printf("Used %s prompt + %s completion tokens",
+						formatThousands(sessionUsage.PromptTokens),
+						formatThousands(sessionUsage.CompletionTokens))
+					if cost > 0 {
+						info.Printf(" (~$%.4f)", cost)
+					}
+					fmt.Println()
+				}
+			}
+
+			// git finishes the commit itself; running git commit here would recurse
+			if messageFile != "" {
+				return writeMessageFile(messageFile, message)
+			}
+
+			output := buildJSONOutput(message, gitInfo)
+			output.DryRun = dryRun
+			printJSON := func() error {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(output)
+			}
+
+			if dryRun {
+				if jsonMode {
+					return printJSON()
+				}
+				fmt.Println(message)
+				return nil
+			}
+
+			// newRecord describes this run's message for the commit cache
+			newRecord := func(message, reason string) CommitRecord {
+				return CommitRecord{
+					Message:          message,
+					Reason:           reason,
+					Provider:         config.AI.Provider,
+					Model:            config.AI.Model,
+					DurationMs:       generationTime.Milliseconds(),
+					PromptTokens:     sessionUsage.PromptTokens,
+					CompletionTokens: sessionUsage.CompletionTokens,
+				}
+			}
+
+			autoConfirm, _ := cmd.Flags().GetBool("yes")
+			if !autoConfirm {
+				regenerate := func(rejected string) (string, error) {
+					started := time.Now()
+					generations.Bypass = true
+					gitInfo.Rejected = append(gitInfo.Rejected, rejected)
+					message, err := generateCommitMessage(gitInfo)
+					generationTime = time.Since(started)
+					return message, err
+				}
+				var proceed bool
+				message, proceed, err = confirmCommit(message, gitInfo, paths, regenerate)
+				if err != nil {
+					return err
+				}
+				if !proceed {
+					cache.Add(newRecord(message, reasonCancelled))
+					fmt.Println("commit cancelled by user")
+					return nil
+				}
+			}
+
+			// Pass the message through a file so multi-line bodies and
+			// trailers reach git exactly as generated
+			messageTemp, err := os.CreateTemp("", "zing-commit-*.txt")
+			if err != nil {
+				return fmt.Errorf("error creating commit message file: %w", err)
+			}
+			defer os.Remove(messageTemp.Name())
+			_, err = messageTemp.WriteString(message + "\n")
+			if closeErr := messageTemp.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("error writing commit message file: %w", err)
+			}
+
+			// Prepare commit command
+			args = append(signConfig, "commit", "-F", messageTemp.Name())
+			if config.Commit.SignCommits {
+				args = append(args, "-S")
+			}
+			if config.Display.Quiet {
+				args = append(args, "--quiet")
+			}
+			if noVerify {
+				args = append(args, "--no-verify")
+			}
+
+			// Execute git commit, streaming hook output as it happens. Hooks
+			// may prompt, so they get the terminal too.
+			commitCmd := exec.Command("git", args...)
+			if len(paths) > 0 {
+				// Commit only the staged state of the paths, leaving any
+				// other staged changes and the working tree alone
+				indexFile, err := stagedPathsIndex(paths)
+				if err != nil {
+					return err
+				}
+				defer os.Remove(indexFile)
+				commitCmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
+			}
+			commitCmd.Stdin = os.Stdin
+			commitCmd.Stdout = os.Stdout
+			if jsonMode {
+				commitCmd.Stdout = os.Stderr
+			}
+			commitCmd.Stderr = os.Stderr
+			if err := commitCmd.Run(); err != nil {
+				// Keep the message so a failing hook doesn't cost a generation
+				cache.Add(newRecord(message, reasonCommitFailed))
+				if !cache.ReadOnly {
+					warn.Fprintln(os.Stderr, "The message was kept; `zing cache list` shows it")
+				}
+				return fmt.Errorf("error executing git commit: %w", err)
+			}
+
+			// Get the commit hash
+			hashCmd := exec.Command("git", "rev-parse", "HEAD")
+			hashOutput, err := hashCmd.Output()
+			if err == nil {
+				hash := strings.TrimSpace(string(hashOutput))
+				record := newRecord(message, "")
+				record.Hash, record.Success = hash, true
+				cache.Add(record)
+				output.Commit = hash
+
+				if config.Commit.AttachNote {
+					if err := attachGenerationNote(hash); err != nil {
+						warn.Printf("Could not attach git note: %v\n", err)
+					}
+				}
+			}
+
+			if jsonMode {
+				return printJSON()
+			}
+			if !config.Display.Quiet {
+				info.Println("Successfully committed changes!")
+			}
+			return nil
+		},
+	}
+
+	// Add flags
+	rootCmd.PersistentFlags().Bool("debug", false, "Print debug output, including the full prompt")
+	rootCmd.PersistentFlags().Bool("no-color", false, "Disable colored output (also set by NO_COLOR)")
+	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "Print only essential output, like display.quiet")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		// Before setup, so its warnings are colored right too
+		noColorFlag, _ = cmd.Flags().GetBool("no-color")
+		applyColor()
+		if err := setup(); err != nil {
+			// A broken config must not lock the user out of repairing it
+			canRepair := cmd.Name() == "doctor" || (cmd.Parent() != nil && cmd.Parent().Name() == "config")
+			if !errors.Is(err, errInvalidConfig) {
+				return err
+			}
+			if !canRepair {
+				return fmt.Errorf("%w\nRun `zing config edit` to fix it, or `zing config reset` to start over", err)
+			}
+			configLoadErr = err
+			warn.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		if enabled, _ := cmd.Flags().GetBool("debug"); enabled {
+			config.Display.Debug = true
+		}
+		if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
+			config.Display.Quiet = true
+		}
+		debugLog("Using config file %s", configFile)
+		return nil
+	}
+
+	rootCmd.Flags().BoolP("yes", "y", false, "Automatically confirm and proceed with commit")
+	rootCmd.Flags().BoolP("interactive", "i", false, "Pick files to stage when nothing is staged yet")
+	rootCmd.Flags().String("message-file", "", "Write the message to this file instead of committing")
+	rootCmd.Flags().String("hook-mode", "", "Run as the named git hook (prepare-commit-msg); used by zing hooks")
+	addGenerationFlags(rootCmd)
+	rootCmd.Flags().BoolP("version", "v", false, "Show version information")
+	rootCmd.Flags().StringP("output", "o", "text", "Output format: text or json")
+	rootCmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp))
+	rootCmd.Flags().Bool("dry-run", false, "Generate and print the message without committing")
+	rootCmd.Flags().Bool("json", false, "Shorthand for --output json --dry-run")
+	rootCmd.Flags().Bool("no-cache-write", false, "Do not record the commit in the local cache")
+	rootCmd.Flags().StringArray("co-author", nil, "Add a \"Name <email>\" co-author for this commit (repeatable)")
+	rootCmd.Flags().BoolP("signoff", "s", false, "Add a Signed-off-by trailer, like git commit -s")
+	rootCmd.Flags().StringArray("trailer", nil, "Append a \"Key: value\" trailer such as \"Reviewed-by: Name <email>\" (repeatable)")
+	rootCmd.Flags().Bool("co-author-only", false, "Use only the --co-author values, ignoring co_authors from the config")
+	rootCmd.Flags().Bool("no-verify", false, "Skip conventional format verification and git commit hooks")
+
+	// Config command
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage configuration",
+		Long:  "View or modify Zing configuration settings",
+	}
+
+	// Show config
+	var showConfigCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Show current configuration",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("Config file location: %s\n\n", configFile)
+			if configLoadErr != nil {
+				// Show the file as written so the problem can be spotted
+				data, _ := os.ReadFile(configFile)
+				fmt.Printf("Raw configuration:\n%s", data)
+				return
+			}
+			fmt.Printf("Current configuration:\n")
+			encoder := toml.NewEncoder(os.Stdout)
+			encoder.Encode(config)
+		},
+	}
+
+	// Edit config
+	var editConfigCmd = &cobra.Command{
+		Use:   "edit",
+		Short: "Open configuration file in default editor",
+		Run: func(cmd *cobra.Command, args []string) {
+			editor, err := findEditor()
+			if err != nil {
+				error_.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			editCmd := exec.Command(editor[0], append(editor[1:], configFile)...)
+			editCmd.Stdin = os.Stdin
+			editCmd.Stdout = os.Stdout
+			editCmd.Stderr = os.Stderr
+
+			if err := editCmd.Run(); err != nil {
+				error_.Fprintf(os.Stderr, "Error opening editor: %v\n", err)
+				os.Exit(1)
+			}
+
+			if err := loadConfig(); err != nil {
+				error_.Fprintf(os.Stderr, "Error reloading config: %v\n", err)
+				os.Exit(1)
+			}
+			configLoadErr = nil
+			applyConfig()
+			info.Println("Configuration reloaded successfully")
+		},
+	}
+
+	// Validate config
+	var validateConfigCmd = &cobra.Command{
+		Use:           "validate",
+		Short:         "Check the configuration file for unknown keys and invalid values",
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			problems := validateConfigFile(configFile)
+			if len(problems) == 0 {
+				info.Println("config OK")
+				return nil
+			}
+			for _, problem := range problems {
+				error_.Printf("✗ %s\n", problem)
+			}
+			return fmt.Errorf("%s has %d problem(s)", configFile, len(problems))
+		},
+	}
+
+	// Reset config
+	var resetConfigCmd = &cobra.Command{
+		Use:          "reset",
+		Short:        "Back up the configuration file and write a fresh default",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backup := configFile + ".bak"
+			if autoConfirm, _ := cmd.Flags().GetBool("yes"); !autoConfirm {
+				fmt.Printf("Replace %s with the defaults? The current file is kept as %s. [y/N] ", configFile, backup)
+				var response string
+				fmt.Scanln(&response)
+				response = strings.ToLower(strings.TrimSpace(response))
+				if response != "y" && response != "yes" {
+					fmt.Println("reset cancelled by user")
+					return nil
+				}
+			}
+
+			if err := os.Rename(configFile, backup); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error backing up config file: %w", err)
+			}
+			config = defaultConfig()
+			if err := saveConfig(); err != nil {
+				return fmt.Errorf("error writing default config: %w", err)
+			}
+			configLoadErr = nil
+			applyConfig()
+			info.Printf("Configuration reset; the previous file is at %s\n", backup)
+			return nil
+		},
+	}
+	resetConfigCmd.Flags().BoolP("yes", "y", false, "Reset without asking for confirmation")
+
+	// Add template command
 	var templateCmd = &cobra.Command{
 		Use:   "template",
 		Short: "Manage commit message templates",
 	}
 
-	var addTemplateCmd = &cobra.Command{
-		Use:   "add [name] [template]",
-		Short: "Add a new commit message template",
-		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
-			name := args[0]
-			templateStr := args[1]
+	var addTemplateCmd = &cobra.Command{
+		Use:   "add [name] [template]",
+		Short: "Add a new commit message template",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			templateStr := args[1]
+
+			// Validate template
+			_, err := template.New(name).Parse(templateStr)
+			if err != nil {
+				error_.Fprintf(os.Stderr, "Invalid template: %v\n", err)
+				os.Exit(1)
+			}
+
+			config.Template.CustomTemplates[name] = templateStr
+			if err := saveConfig(); err != nil {
+				error_.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+				os.Exit(1)
+			}
+			info.Printf("Template '%s' added successfully\n", name)
+		},
+	}
+
+	// Preview command
+	var previewCmd = &cobra.Command{
+		Use:   "preview [paths...]",
+		Short: "Show the prompt that would be sent to the AI provider",
+		Long: `Print the prompt exactly as it will be sent to the provider. It is built
+the same way as for a commit: ignore paths, language filters and --only,
+the ai.max_prompt_tokens budget and system.prompt_filter_command are all
+applied. Nothing is sent to the provider.`,
+		Args: cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			gitInfo, err := stagedGitInfo(args)
+			if err != nil {
+				return err
+			}
+			if err := applyGenerationFlags(cmd); err != nil {
+				return err
+			}
+			gitInfo.Context, _ = cmd.Flags().GetString("context")
+
+			addJiraSummary(gitInfo)
+			if len(gitInfo.Files) == 0 {
+				info.Fprintln(os.Stderr, "Nothing would be sent: every staged file is ignored, so the message is built from the file stats")
+				return nil
+			}
+			prompt, err := preparePrompt(gitInfo)
+			if err != nil {
+				return err
+			}
+			fmt.Println(prompt)
+			return nil
+		},
+	}
+	addGenerationFlags(previewCmd)
+
+	// Generate command
+	var generateCmd = &cobra.Command{
+		Use:   "generate [paths...]",
+		Short: "Generate a commit message without committing",
+		Long: `Generate a commit message for the staged changes and print it to stdout,
+or write it to a file with --file. This never commits, prompts or records
+the message in the commit cache, making it a stable entry point for hooks
+and editor plugins. Replies still go into the generation cache and token
+usage is still counted.
+
+With --stdin the changes are read from a git-style diff on standard input
+instead of the index, so no repository is needed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache.NoRecords = true
+
+			useStdin, _ := cmd.Flags().GetBool("stdin")
+			sinceLastPush, _ := cmd.Flags().GetBool("since-last-push")
+			if useStdin && (len(args) > 0 || sinceLastPush) {
+				return fmt.Errorf("--stdin cannot be combined with paths or --since-last-push")
+			}
+
+			var unpushed []string
+			if sinceLastPush {
+				base, subjects, err := resolvePushBase()
+				if err != nil {
+					return err
+				}
+				diffBase, unpushed = base, subjects
+			}
+
+			var gitInfo *GitInfo
+			var err error
+			if useStdin {
+				gitInfo, err = stdinGitInfo(os.Stdin)
+			} else {
+				gitInfo, err = stagedGitInfo(args)
+			}
+			if err != nil {
+				return err
+			}
+			gitInfo.Unpushed = unpushed
+			if err := applyGenerationFlags(cmd); err != nil {
+				return err
+			}
+			gitInfo.Context, _ = cmd.Flags().GetString("context")
+
+			message, err := generateCommitMessage(gitInfo)
+			if err != nil {
+				return fmt.Errorf("error generating commit message: %w", err)
+			}
+
+			if file, _ := cmd.Flags().GetString("file"); file != "" {
+				return os.WriteFile(file, []byte(message+"\n"), 0644)
+			}
+			fmt.Println(message)
+			return nil
+		},
+	}
+	addGenerationFlags(generateCmd)
+	generateCmd.Flags().StringP("file", "f", "", "Write the message to this file instead of stdout")
+	generateCmd.Flags().Bool("stdin", false, "Read a unified diff from stdin instead of the staged changes")
+	generateCmd.Flags().Bool("since-last-push", false, "Describe all unpushed commits plus staged changes as one message")
+
+	// Suggest command
+	var suggestCmd = &cobra.Command{
+		Use:   "suggest <rev> [paths...]",
+		Short: "Suggest a message for an existing commit",
+		Long: `Generate a message for the changes an existing commit introduced, compared
+to its first parent, and print it to stdout. Nothing is committed or
+amended, which makes it handy while rewording during an interactive
+rebase. Replies are only stored in the generation cache with --cache.`,
+		Args:          cobra.MinimumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Token usage is always counted; only the reply is opt-in
+			useCache, _ := cmd.Flags().GetBool("cache")
+			cache.NoRecords = true
+			generations.NoStore = !useCache
+
+			base, target, err := resolveCommitRange(args[0])
+			if err != nil {
+				return err
+			}
+			diffBase, diffTarget = base, target
+
+			gitInfo, err := stagedGitInfo(args[1:])
+			if err != nil {
+				return err
+			}
+			if err := applyGenerationFlags(cmd); err != nil {
+				return err
+			}
+			gitInfo.Context, _ = cmd.Flags().GetString("context")
+
+			message, err := generateCommitMessage(gitInfo)
+			if err != nil {
+				return fmt.Errorf("error generating commit message: %w", err)
+			}
+			fmt.Println(message)
+			return nil
+		},
+	}
+	addGenerationFlags(suggestCmd)
+	suggestCmd.Flags().Bool("cache", false, "Store the reply in the generation cache")
+	rootCmd.AddCommand(suggestCmd)
+
+	// Lint command
+	var lintCmd = &cobra.Command{
+		Use:   "lint [rev-range]",
+		Short: "Check existing commits against the commit rules",
+		Long: `Verify every commit in a revision range (origin/main..HEAD by default)
+with the same checks applied to generated messages. Exits non-zero if any
+commit fails. Use --from and --to instead of a range if that reads better.`,
+		Args:          cobra.MaximumNArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			applyCommitlint()
+			from, _ := cmd.Flags().GetString("from")
+			to, _ := cmd.Flags().GetString("to")
+			revRange := "origin/main..HEAD"
+			switch {
+			case len(args) == 1 && (from != "" || to != ""):
+				return fmt.Errorf("use either a rev-range or --from/--to, not both")
+			case len(args) == 1:
+				revRange = args[0]
+			case from != "" || to != "":
+				if to == "" {
+					to = "HEAD"
+				}
+				if from == "" {
+					revRange = to
+				} else {
+					revRange = from + ".." + to
+				}
+			}
+			return lintCommits(revRange)
+		},
+	}
+	lintCmd.Flags().String("from", "", "Start of the range (exclusive)")
+	lintCmd.Flags().String("to", "", "End of the range (default HEAD)")
+
+	// Changelog command
+	var changelogCmd = &cobra.Command{
+		Use:   "changelog [rev-range]",
+		Short: "Generate a Markdown changelog from conventional commits",
+		Long: `Group the conventional commits in a revision range by type and print a
+Keep a Changelog style section. The range defaults to everything since the
+latest tag. Breaking changes are collected from "!" markers and
+BREAKING CHANGE footers into their own section.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			revRange := "HEAD"
+			if len(args) == 1 {
+				revRange = args[0]
+			} else if tag, err := exec.Command("git", "describe", "--tags", "--abbrev=0").Output(); err == nil {
+				revRange = strings.TrimSpace(string(tag)) + "..HEAD"
+			}
+			scopes, _ := cmd.Flags().GetStringSlice("scope")
+
+			changelog, err := buildChangelog(revRange, scopes)
+			if err != nil {
+				return err
+			}
+			if file, _ := cmd.Flags().GetString("output"); file != "" {
+				return os.WriteFile(file, []byte(changelog), 0644)
+			}
+			fmt.Print(changelog)
+			return nil
+		},
+	}
+	changelogCmd.Flags().StringSlice("scope", nil, "Only include commits with these scopes")
+	changelogCmd.Flags().StringP("output", "o", "", "Write the changelog to this file instead of stdout")
+
+	// Cache command
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect the local commit cache",
+	}
+
+	// Kept so existing scripts work; `zing stats` shows the same numbers
+	var cacheStatsCmd = &cobra.Command{
+		Use:           "stats",
+		Short:         "Same as `zing stats`",
+		Args:          cobra.NoArgs,
+		Hidden:        true,
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE:          runStats,
+	}
+	addStatsFlags(cacheStatsCmd)
+
+	var cacheListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List cached commits with the model and time behind each message",
+		Run: func(cmd *cobra.Command, args []string) {
+			failed, _ := cmd.Flags().GetBool("failed")
+			var records []CommitRecord
+			for _, record := range cache.Records {
+				if !failed || !record.Success {
+					records = append(records, record)
+				}
+			}
+			if len(records) == 0 {
+				if failed {
+					fmt.Println("No failed commits")
+				} else {
+					fmt.Println("No cached commits yet")
+				}
+				return
+			}
+			sort.Slice(records, func(i, j int) bool {
+				return records[i].Timestamp.After(records[j].Timestamp)
+			})
+			if limit, _ := cmd.Flags().GetInt("limit"); limit > 0 && len(records) > limit {
+				records = records[:limit]
+			}
+
+			for _, record := range records {
+				label := record.Hash
+				if !record.Success {
+					label = "failed"
+				}
+				fmt.Printf("%s  %-7.7s  %s\n", record.Timestamp.Format(config.Display.TimeFormat), label, strings.SplitN(record.Message, "\n", 2)[0])
+				if failed {
+					// The whole message, ready to reuse
+					for _, line := range strings.Split(record.Message, "\n") {
+						fmt.Printf("    | %s\n", line)
+					}
+				}
+
+				var details []string
+				if record.Reason != "" {
+					details = append(details, record.Reason)
+				}
+				// Records from older versions carry no generation details
+				if record.Model != "" {
+					details = append(details, record.Provider+"/"+record.Model)
+				}
+				if record.DurationMs > 0 {
+					details = append(details, (time.Duration(record.DurationMs) * time.Millisecond).String())
+				}
+				if record.PromptTokens > 0 || record.CompletionTokens > 0 {
+					details = append(details, fmt.Sprintf("%s prompt + %s completion tokens",
+						formatThousands(record.PromptTokens), formatThousands(record.CompletionTokens)))
+				}
+				if len(details) > 0 {
+					fmt.Printf("    %s\n", strings.Join(details, ", "))
+				}
+			}
+		},
+	}
+	cacheListCmd.Flags().IntP("limit", "n", 20, "Show at most this many commits, 0 for all")
+	cacheListCmd.Flags().Bool("failed", false, "Only show messages that were cancelled or not committed, in full")
+
+	// Add commands
+	cacheCmd.AddCommand(cacheStatsCmd, cacheListCmd)
+	templateCmd.AddCommand(addTemplateCmd)
+	configCmd.AddCommand(showConfigCmd, editConfigCmd, validateConfigCmd, resetConfigCmd)
+	rootCmd.AddCommand(configCmd, templateCmd, cacheCmd, previewCmd, generateCmd, lintCmd, changelogCmd)
+
+	// Initialize hooks command
+	var hooksCmd = &cobra.Command{
+		Use:   "hooks",
+		Short: "Manage git hooks",
+		Run: func(cmd *cobra.Command, args []string) {
+			hookPath, err := installGitHooks()
+			if err != nil {
+				error_.Fprintf(os.Stderr, "Error installing git hooks: %v\n", err)
+				os.Exit(1)
+			}
+			info.Printf("Git hooks installed successfully at %s\n", hookPath)
+		},
+	}
+
+	rootCmd.AddCommand(hooksCmd)
+
+	var doctorCmd = &cobra.Command{
+		Use:           "doctor",
+		Short:         "Check that git, the config and the AI provider are set up",
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if failed := printChecks(runDoctorChecks()); failed > 0 {
+				return fmt.Errorf("%d critical check(s) failed", failed)
+			}
+			return nil
+		},
+	}
+	rootCmd.AddCommand(doctorCmd)
+
+	var checkCmd = &cobra.Command{
+		Use:   "check [paths...]",
+		Short: "Check that the staged changes can be turned into a commit, without calling the AI",
+		Long: `Run every step before generation: find the staged changes, apply ignore
+rules and limits, and check the provider settings and commit signing.
+Nothing is sent to the provider, so this is cheap enough for CI and
+pre-commit automation. Exits non-zero if generation would fail.`,
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if config.AI.DefaultProfile != "" {
+				if err := applyProfile(config.AI.DefaultProfile); err != nil {
+					return err
+				}
+			}
+			if failed := printChecks(runReadinessChecks(args)); failed > 0 {
+				return fmt.Errorf("not ready to commit: %d check(s) failed", failed)
+			}
+			return nil
+		},
+	}
+	rootCmd.AddCommand(checkCmd)
+
+	var modelsCmd = &cobra.Command{
+		Use:          "models",
+		Short:        "List the models available on the Ollama server",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
+			defer cancel()
+			models, err := listOllamaModels(ctx)
+			if err != nil {
+				return err
+			}
+			if len(models) == 0 {
+				warn.Printf("No models on %s; pull one with `ollama pull <model>`\n", ollamaBaseURL())
+				return nil
+			}
+
+			for _, model := range models {
+				marker := " "
+				if config.AI.Provider == "ollama" && hasOllamaModel([]string{model}, config.AI.Model) {
+					marker = "*"
+				}
+				fmt.Printf("%s %s\n", marker, model)
+			}
+			if config.AI.Provider == "ollama" && !hasOllamaModel(models, config.AI.Model) {
+				warn.Printf("Configured model %s is not available. %s\n", config.AI.Model, ollamaModelHint(config.AI.Model, models))
+			}
+			return nil
+		},
+	}
+	rootCmd.AddCommand(modelsCmd)
+
+	var statsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Summarize the commits zing has made and the tokens it used",
+		Long: `Summarize what zing has done. The commit numbers come from the commit
+cache: how many messages zing wrote and how many were committed, the
+average generation time, which providers and models wrote them and the most
+common commit types. The token usage comes from the usage ledger, which
+counts every provider call by month, including zing generate, zing suggest,
+retries and regenerations.`,
+		Args:          cobra.NoArgs,
+		SilenceUsage:  true,
+		SilenceErrors: true, // main reports the error
+		RunE:          runStats,
+	}
+	addStatsFlags(statsCmd)
+	rootCmd.AddCommand(statsCmd)
+
+	var completionCmd = &cobra.Command{
+		Use:   "completion [bash|zsh|fish|powershell]",
+		Short: "Generate a shell completion script",
+		Long: `Print a completion script for the given shell. For example:
+
+  bash: source <(zing completion bash)
+  zsh:  zing completion zsh > "${fpath[1]}/_zing"
+  fish: zing completion fish > ~/.config/fish/completions/zing.fish
+  powershell: zing completion powershell | Out-String | Invoke-Expression
+
+Flags such as --template and --profile complete from your config.`,
+		Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "bash":
+				return rootCmd.GenBashCompletionV2(os.Stdout, true)
+			case "zsh":
+				return rootCmd.GenZshCompletion(os.Stdout)
+			case "fish":
+				return rootCmd.GenFishCompletion(os.Stdout, true)
+			default:
+				return rootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+			}
+		},
+	}
+	rootCmd.AddCommand(completionCmd)
+
+	if err := rootCmd.Execute(); err != nil {
+		error_.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// stagedPathsIndex builds a temporary index holding HEAD plus the staged
+// changes under paths, so committing from it records exactly what was staged
+// there. `git commit -- <paths>` would take the working tree copies instead.
+// The caller commits with GIT_INDEX_FILE set to the returned file and
+// removes it afterwards.
+func stagedPathsIndex(paths []string) (string, error) {
+	indexTemp, err := os.CreateTemp("", "zing-index-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary index: %w", err)
+	}
+	indexFile := indexTemp.Name()
+	// git refuses to read an empty file as an index, so let read-tree create it
+	indexTemp.Close()
+	os.Remove(indexFile)
+
+	fail := func(err error) (string, error) {
+		os.Remove(indexFile)
+		return "", err
+	}
+	tempIndex := func(args ...string) *exec.Cmd {
+		cmd := exec.Command("git", args...)
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
+		return cmd
+	}
+
+	readTree := tempIndex("read-tree", "HEAD")
+	if exec.Command("git", "rev-parse", "--verify", "--quiet", "HEAD").Run() != nil {
+		readTree = tempIndex("read-tree", "--empty") // First commit
+	}
+	if output, err := readTree.CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("error preparing temporary index: %w: %s", err, strings.TrimSpace(string(output))))
+	}
+
+	// Each raw record carries the staged mode and blob; a deletion has mode
+	// 000000, which update-index takes as a removal
+	args := append([]string{"diff", "--cached", "--raw", "-z", "--no-abbrev", "--no-renames", "--"}, paths...)
+	output, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return fail(fmt.Errorf("error reading staged changes: %w", err))
+	}
+	var entries strings.Builder
+	fields := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) < 4 {
+			continue
+		}
+		fmt.Fprintf(&entries, "%s %s\t%s\x00", meta[1], meta[3], fields[i+1])
+	}
+
+	update := tempIndex("update-index", "-z", "--index-info")
+	update.Stdin = strings.NewReader(entries.String())
+	if output, err := update.CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("error staging paths in temporary index: %w: %s", err, strings.TrimSpace(string(output))))
+	}
+	return indexFile, nil
+}
+
+// CacheStats summarizes commit cache records for `zing stats`.
+type CacheStats struct {
+	Commits       int            `json:"commits"`
+	Succeeded     int            `json:"succeeded"`
+	SuccessRate   float64        `json:"success_rate"`    // 0 to 1
+	AvgDurationMs int64          `json:"avg_duration_ms"` // Over records that carry a duration
+	Providers     []StatCount    `json:"providers"`
+	Models        []StatCount    `json:"models"`
+	Types         []StatCount    `json:"types"`
+	Usage         []MonthlyUsage `json:"usage"` // From the usage ledger, newest month first
+}
+
+// MonthlyUsage is one month of the usage ledger.
+type MonthlyUsage struct {
+	Month string `json:"month"` // "2006-01"
+	UsageTotal
+}
+
+type StatCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// summarizeCache aggregates the records made at or after since; a zero
+// since includes everything. Records from before generation details were
+// kept count towards "unknown".
+func summarizeCache(records map[string]CommitRecord, since time.Time) CacheStats {
+	providers := make(map[string]int)
+	models := make(map[string]int)
+	types := make(map[string]int)
+	var stats CacheStats
+	var totalMs int64
+	var timed int64
+	for _, record := range records {
+		if record.Timestamp.Before(since) {
+			continue
+		}
+		stats.Commits++
+		if record.Success {
+			stats.Succeeded++
+		}
+		if record.DurationMs > 0 {
+			totalMs += record.DurationMs
+			timed++
+		}
+
+		provider, model := record.Provider, record.Provider+"/"+record.Model
+		if record.Model == "" {
+			provider, model = "unknown", "unknown"
+		}
+		providers[provider]++
+		models[model]++
+
+		typ := "other"
+		if match := commitTypeRegex.FindStringSubmatch(record.Message); match != nil {
+			typ = strings.ToLower(match[1])
+		}
+		types[typ]++
+	}
+
+	if stats.Commits > 0 {
+		stats.SuccessRate = float64(stats.Succeeded) / float64(stats.Commits)
+	}
+	if timed > 0 {
+		stats.AvgDurationMs = totalMs / timed
+	}
+	stats.Providers = sortedCounts(providers)
+	stats.Models = sortedCounts(models)
+	stats.Types = sortedCounts(types)
+	return stats
+}
+
+// sortedCounts orders counts from most to least common, then by name.
+func sortedCounts(counts map[string]int) []StatCount {
+	sorted := []StatCount{}
+	for name, count := range counts {
+		sorted = append(sorted, StatCount{name, count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// printCacheStats prints stats as small aligned tables.
+func printCacheStats(stats CacheStats) {
+	defer printUsage(stats.Usage)
+	if stats.Commits == 0 {
+		fmt.Println("No commits recorded yet")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Commits\t%d (%.0f%% succeeded)\n", stats.Commits, stats.SuccessRate*100)
+	if stats.AvgDurationMs > 0 {
+		fmt.Fprintf(w, "Avg generation\t%s\n", time.Duration(stats.AvgDurationMs)*time.Millisecond)
+	}
+	for _, section := range []struct {
+		title  string
+		counts []StatCount
+	}{
+		{"Provider", stats.Providers},
+		{"Model", stats.Models},
+		{"Type", stats.Types},
+	} {
+		fmt.Fprintf(w, "\n%s\tCommits\n", section.title)
+		for _, entry := range section.counts {
+			fmt.Fprintf(w, "  %s\t%d (%.0f%%)\n", entry.Name, entry.Count, float64(entry.Count)/float64(stats.Commits)*100)
+		}
+	}
+	w.Flush()
+}
+
+// printUsage prints the monthly token totals under the commit summary.
+func printUsage(usage []MonthlyUsage) {
+	if len(usage) == 0 {
+		fmt.Println("\nNo token usage recorded yet")
+		return
+	}
+	fmt.Println("\nToken usage by month:")
+	for _, month := range usage {
+		fmt.Printf("  %s: %d requests, %s prompt + %s completion tokens",
+			month.Month, month.Requests,
+			formatThousands(month.PromptTokens),
+			formatThousands(month.CompletionTokens))
+		if month.Cost > 0 {
+			fmt.Printf(", ~$%.2f", month.Cost)
+		}
+		fmt.Println()
+	}
+}
+
+// summarizeUsage lists the ledger months that overlap the period starting
+// at since, newest first; a zero since includes everything.
+func summarizeUsage(months map[string]UsageTotal, since time.Time) []MonthlyUsage {
+	usage := []MonthlyUsage{}
+	first := since.Format("2006-01")
+	for month, total := range months {
+		if since.IsZero() || month >= first {
+			usage = append(usage, MonthlyUsage{Month: month, UsageTotal: total})
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Month > usage[j].Month })
+	return usage
+}
+
+// addStatsFlags registers the flags of `zing stats` and its `zing cache
+// stats` alias.
+func addStatsFlags(cmd *cobra.Command) {
+	cmd.Flags().String("since", "", "Only count commits and months from this period, e.g. 12h, 7d or 4w")
+	cmd.Flags().Bool("json", false, "Print the summary as JSON")
+}
+
+// runStats prints the commit summary and monthly token usage.
+func runStats(cmd *cobra.Command, args []string) error {
+	var since time.Time
+	if value, _ := cmd.Flags().GetString("since"); value != "" {
+		age, err := parseSince(value)
+		if err != nil {
+			return err
+		}
+		since = time.Now().Add(-age)
+	}
+	stats := summarizeCache(cache.Records, since)
+	stats.Usage = summarizeUsage(ledger.Months, since)
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	printCacheStats(stats)
+	return nil
+}
+
+// parseSince parses a --since period. On top of Go durations such as 12h it
+// accepts whole days and weeks, e.g. 7d or 4w.
+func parseSince(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			if n, err := strconv.Atoi(number); err == nil && n >= 0 {
+				return time.Duration(n) * unit, nil
+			}
+		}
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid --since %q: use a duration like 12h, 7d or 4w", value)
+	}
+	return age, nil
+}
+
+// lintCommits verifies each non-merge commit in revRange and reports the
+// result per commit.
+func lintCommits(revRange string) error {
+	output, err := exec.Command("git", "log", "-z", "--no-merges", "--format=%h %B", revRange, "--").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("error reading commits in %s: %s", revRange, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return fmt.Errorf("error reading commits in %s: %w", revRange, err)
+	}
+
+	total, failed := 0, 0
+	for _, record := range strings.Split(string(output), "\x00") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		hash, message, _ := strings.Cut(record, " ")
+		message = strings.TrimSpace(message)
+		subject, _, _ := strings.Cut(message, "\n")
+		total++
+
+		if err := verifyConventionalCommit(message); err != nil {
+			failed++
+			error_.Printf("✗ %s %s\n", hash, subject)
+			fmt.Printf("    %v\n", err)
+			continue
+		}
+		info.Printf("✓ %s %s\n", hash, subject)
+	}
+
+	if total == 0 {
+		fmt.Printf("No commits in %s\n", revRange)
+		return nil
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commits failed lint", failed, total)
+	}
+	fmt.Printf("All %d commits passed\n", total)
+	return nil
+}
+
+// changelogSections orders the changelog headings. Types not listed here are
+// grouped under "Other Changes".
+var changelogSections = []struct {
+	Type  string
+	Title string
+}{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"refactor", "Refactoring"},
+	{"docs", "Documentation"},
+	{"style", "Style"},
+	{"test", "Tests"},
+	{"build", "Build"},
+	{"ci", "CI"},
+	{"chore", "Chores"},
+}
+
+// buildChangelog renders the conventional commits in revRange as Markdown,
+// optionally keeping only the given scopes. Non-conventional commits are
+// left out.
+func buildChangelog(revRange string, scopes []string) (string, error) {
+	output, err := exec.Command("git", "log", "-z", "--no-merges", "--format=%h %B", revRange, "--").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("error reading commits in %s: %s", revRange, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("error reading commits in %s: %w", revRange, err)
+	}
+
+	entries := make(map[string][]string)
+	var breaking []string
+	for _, record := range strings.Split(string(output), "\x00") {
+		if strings.TrimSpace(record) == "" {
+			continue
+		}
+		hash, message, _ := strings.Cut(record, " ")
+		data, ok := parseConventionalCommit(message)
+		if !ok {
+			continue
+		}
+		if len(scopes) > 0 && !slices.Contains(scopes, data.Scope) {
+			continue
+		}
+
+		entry := data.Description
+		if data.Scope != "" {
+			entry = fmt.Sprintf("**%s:** %s", data.Scope, entry)
+		}
+		entry = fmt.Sprintf("- %s (%s)", entry, hash)
+
+		section := "other"
+		for _, s := range changelogSections {
+			if s.Type == data.Type {
+				section = s.Type
+			}
+		}
+		entries[section] = append(entries[section], entry)
+		if data.Breaking != "" {
+			note := data.Breaking
+			if data.Scope != "" {
+				note = fmt.Sprintf("**%s:** %s", data.Scope, note)
+			}
+			breaking = append(breaking, fmt.Sprintf("- %s (%s)", note, hash))
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString("## [Unreleased]\n")
+	writeSection := func(title string, lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		fmt.Fprintf(&out, "\n### %s\n\n%s\n", title, strings.Join(lines, "\n"))
+	}
+	writeSection("⚠ BREAKING CHANGES", breaking)
+	for _, s := range changelogSections {
+		writeSection(s.Title, entries[s.Type])
+	}
+	writeSection("Other Changes", entries["other"])
+	return out.String(), nil
+}
+
+// autoDiffViewLines is the changed-line count above which diff_view "auto"
+// shows a stat summary instead of the full diff.
+const autoDiffViewLines = 200
+
+// confirmCommit shows the message and lets the user accept, edit or
+// regenerate it, toggle the staged diff, or quit. On a terminal each action
+// is a single keypress; otherwise a line is read and Enter accepts. It
+// returns the latest message and whether to commit it.
+func confirmCommit(message string, gitInfo *GitInfo, paths []string, regenerate func(rejected string) (string, error)) (string, bool, error) {
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	reader := bufio.NewReader(os.Stdin)
+	showDiff := config.Display.ShowDiff
+	for {
+		fmt.Printf("\nGenerated commit message:\n%s\n\n", message)
+		if showDiff {
+			showStagedDiff(gitInfo, paths)
+		}
+
+		var choice string
+		if interactive {
+			fmt.Print("Commit? [y]es, [e]dit, [r]egenerate, [d]iff, [q]uit ")
+			key, err := readKey()
+			if err != nil {
+				return "", false, fmt.Errorf("error reading key: %w", err)
+			}
+			fmt.Println()
+			choice = string(key)
+		} else {
+			fmt.Print("Proceed with commit? [Y/n/e/r/d] ")
+			line, _ := reader.ReadString('\n')
+			choice = strings.TrimSpace(line)
+		}
+
+		switch strings.ToLower(choice) {
+		case "", "y", "yes", "\r", "\n":
+			return message, true, nil
+		case "n", "no", "q", "\x03", "\x1b": // Ctrl-C and Esc quit too
+			return message, false, nil
+		case "e":
+			edited, err := editMessage(message)
+			if err != nil {
+				warn.Printf("Could not edit the message: %v\n", err)
+			} else if edited == "" {
+				warn.Println("The edited message is empty, keeping the previous one")
+			} else {
+				message = edited
+			}
+		case "r":
+			regenerated, err := regenerate(message)
+			if err != nil {
+				warn.Printf("Could not regenerate the message: %v\n", err)
+			} else {
+				message = regenerated
+			}
+		case "d":
+			showDiff = !showDiff
+		default:
+			warn.Printf("Unknown choice %q\n", choice)
+		}
+	}
+}
+
+// readKey reads a single keypress from the terminal without waiting for
+// Enter.
+func readKey() (byte, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 0, err
+	}
+	defer term.Restore(fd, state)
+
+	var key [1]byte
+	if _, err := os.Stdin.Read(key[:]); err != nil {
+		return 0, err
+	}
+	return key[0], nil
+}
+
+// editMessage opens the message in the user's editor and returns the saved
+// text without comment lines.
+func editMessage(message string) (string, error) {
+	editor, err := findEditor()
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "zing-message-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	content := message + "\n\n# Lines starting with '#' are ignored.\n"
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return "", fmt.Errorf("error writing temporary file: %w", err)
+	}
+	file.Close()
+
+	editCmd := exec.Command(editor[0], append(editor[1:], file.Name())...)
+	editCmd.Stdin = os.Stdin
+	editCmd.Stdout = os.Stdout
+	editCmd.Stderr = os.Stderr
+	if err := editCmd.Run(); err != nil {
+		return "", fmt.Errorf("error opening editor: %w", err)
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("error reading edited message: %w", err)
+	}
+	return stripCommentLines(string(data)), nil
+}
+
+// showStagedDiff prints the staged changes for the confirmation prompt in
+// the form chosen by display.diff_view.
+func showStagedDiff(gitInfo *GitInfo, paths []string) {
+	view := config.Display.DiffView
+	if view == "" || view == "auto" {
+		view = "full"
+		if gitInfo.TotalChanges.Additions+gitInfo.TotalChanges.Deletions > autoDiffViewLines {
+			view = "stat"
+		}
+	}
+
+	var args []string
+	switch view {
+	case "none":
+		return
+	case "stat":
+		args = cachedDiffArgs("--stat", "--color")
+	case "full":
+		args = cachedDiffArgs("--color")
+	default:
+		warn.Printf("Unknown display.diff_view %q, showing the full diff\n", view)
+		args = cachedDiffArgs("--color")
+	}
+	if len(paths) > 0 {
+		args = append(append(args, "--"), paths...)
+	}
+
+	fmt.Println("Changes to be committed:")
+	diffCmd := exec.Command("git", args...)
+	diffCmd.Stdout = os.Stdout
+	diffCmd.Run()
+}
+
+// commitSigningConfig returns the `git -c` options needed for
+// commit.sign_format. SSH signing needs gpg.format=ssh and a signing key,
+// so a missing key is reported up front.
+func commitSigningConfig() ([]string, error) {
+	if !config.Commit.SignCommits {
+		return nil, nil
+	}
+	switch config.Commit.SignFormat {
+	case "", "gpg":
+		return nil, nil
+	case "ssh":
+		key, _ := exec.Command("git", "config", "user.signingkey").Output()
+		if strings.TrimSpace(string(key)) == "" {
+			return nil, fmt.Errorf("commit.sign_format is ssh but no signing key is configured; run `git config user.signingkey ~/.ssh/id_ed25519.pub`")
+		}
+		return []string{"-c", "gpg.format=ssh"}, nil
+	default:
+		return nil, fmt.Errorf("unsupported commit.sign_format %q (supported: gpg, ssh)", config.Commit.SignFormat)
+	}
+}
+
+// signoffTrailer builds the DCO Signed-off-by trailer from the committer
+// identity in git config.
+func signoffTrailer() (string, error) {
+	identity := make(map[string]string)
+	for _, key := range []string{"user.name", "user.email"} {
+		output, _ := exec.Command("git", "config", key).Output()
+		identity[key] = strings.TrimSpace(string(output))
+		if identity[key] == "" {
+			return "", fmt.Errorf("signing off needs git's %s; set it with `git config --global %s <value>`", key, key)
+		}
+	}
+	return fmt.Sprintf("Signed-off-by: %s <%s>", identity["user.name"], identity["user.email"]), nil
+}
+
+// stagedGitInfo collects the staged changes, optionally narrowed to paths,
+// and errors when there is nothing to describe.
+func stagedGitInfo(paths []string) (*GitInfo, error) {
+	// Check if we're in a git repository
+	if _, err := exec.Command("git", "rev-parse", "--git-dir").Output(); err != nil {
+		return nil, fmt.Errorf("not a git repository")
+	}
+
+	gitInfo, err := getGitInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(gitInfo.Files) == 0 && len(gitInfo.IgnoredFiles) == 0 {
+		switch {
+		case diffTarget != "":
+			return nil, fmt.Errorf("commit %s has no changes", diffTarget[:7])
+		case diffBase != "":
+			return nil, fmt.Errorf("no changes since the last push")
+		}
+		return nil, fmt.Errorf("no staged changes found")
+	}
+
+	if len(paths) > 0 {
+		if err := filterStagedFiles(gitInfo, paths); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without any content left there is nothing meaningful to send the model
+	if len(gitInfo.Files) == 0 && !config.System.StatFallback {
+		return nil, fmt.Errorf("all staged changes were filtered out by ignore rules")
+	}
+	return gitInfo, nil
+}
+
+// addGenerationFlags registers the per-run generation overrides shared by
+// the root and generate commands.
+func addGenerationFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("template", "t", "", "Use specific commit message template")
+	cmd.Flags().String("provider", "", "Override the AI provider for this run ("+strings.Join(knownProviders, ", ")+")")
+	cmd.Flags().String("profile", "", "Use the named [[ai.profiles]] entry for this run")
+	cmd.Flags().String("model", "", "Override the AI model for this run")
+	cmd.Flags().Int("max-tokens", 0, "Override ai.max_tokens for this run")
+	cmd.Flags().Float32("temperature", 0, "Override ai.temperature for this run (0-2)")
+	cmd.Flags().String("context", "", "Explain the intent of the change to the AI")
+	cmd.Flags().Bool("no-cache", false, "Regenerate even if an identical diff was seen before")
+	cmd.Flags().Bool("explain", false, "Ask the model for a one-line rationale, printed to stderr")
+	cmd.RegisterFlagCompletionFunc("template", completeFromConfig(templateNames))
+	cmd.RegisterFlagCompletionFunc("profile", completeFromConfig(profileNames))
+	cmd.RegisterFlagCompletionFunc("provider", cobra.FixedCompletions(knownProviders, cobra.ShellCompDirectiveNoFileComp))
+	cmd.Flags().StringSlice("only", nil, "Only send diffs of these languages, e.g. --only Go,SQL")
+}
+
+// applyGenerationFlags applies the overrides registered by addGenerationFlags.
+func applyGenerationFlags(cmd *cobra.Command) error {
+	// Individual flags refine the profile, so it goes first
+	profile, _ := cmd.Flags().GetString("profile")
+	if profile == "" {
+		profile = config.AI.DefaultProfile
+	}
+	if profile != "" {
+		if err := applyProfile(profile); err != nil {
+			return err
+		}
+	}
+	if provider, _ := cmd.Flags().GetString("provider"); provider != "" {
+		if err := validateProvider(provider); err != nil {
+			return err
+		}
+		config.AI.Provider = provider
+	}
+	if model, _ := cmd.Flags().GetString("model"); model != "" {
+		config.AI.Model = model
+	}
+	if cmd.Flags().Changed("max-tokens") {
+		maxTokens, _ := cmd.Flags().GetInt("max-tokens")
+		if maxTokens <= 0 {
+			return fmt.Errorf("--max-tokens must be positive, got %d", maxTokens)
+		}
+		config.AI.MaxTokens = maxTokens
+	}
+	if cmd.Flags().Changed("temperature") {
+		temperature, _ := cmd.Flags().GetFloat32("temperature")
+		if temperature < 0 || temperature > 2 {
+			return fmt.Errorf("--temperature must be between 0 and 2, got %g", temperature)
+		}
+		config.AI.Temperature = temperature
+	}
+	if only, _ := cmd.Flags().GetStringSlice("only"); len(only) > 0 {
+		config.System.IncludeLanguages = only
+		config.System.ExcludeLanguages = nil
+	}
+	if noCache, _ := cmd.Flags().GetBool("no-cache"); noCache {
+		generations.Bypass = true
+	}
+	explainMode, _ = cmd.Flags().GetBool("explain")
+	if templateName, _ := cmd.Flags().GetString("template"); templateName != "" {
+		if err := selectTemplate(templateName); err != nil {
+			return err
+		}
+	}
+	applyCommitlint()
+	return nil
+}
+
+// commitlintFiles are the commitlint configs that can be read without
+// running JavaScript, in commitlint's own lookup order.
+var commitlintFiles = []string{".commitlintrc", ".commitlintrc.json", ".commitlintrc.yaml", ".commitlintrc.yml", "package.json"}
 
-			// Validate template
-			_, err := template.New(name).Parse(templateStr)
-			if err != nil {
-				error_.Fprintf(os.Stderr, "Invalid template: %v\n", err)
-				os.Exit(1)
+// applyCommitlint replaces the allowed types and scopes with the type-enum
+// and scope-enum rules of the repository's commitlint config, when
+// commit.commitlint is on.
+func applyCommitlint() {
+	if !config.Commit.Commitlint {
+		return
+	}
+	top, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return
+	}
+	for _, name := range commitlintFiles {
+		path := filepath.Join(strings.TrimSpace(string(top)), name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		rules, err := parseCommitlintRules(name, data)
+		if err != nil {
+			warn.Printf("Could not read %s: %v\n", path, err)
+			return
+		}
+		if rules == nil {
+			// package.json without a commitlint section
+			continue
+		}
+		if types := commitlintEnum(rules["type-enum"]); len(types) > 0 {
+			config.Commit.ScopePrefix = types
+		}
+		if scopes := commitlintEnum(rules["scope-enum"]); len(scopes) > 0 {
+			config.Commit.AllowedScopes = scopes
+		}
+		debugLog("Using types and scopes from %s", path)
+		return
+	}
+}
+
+// parseCommitlintRules returns each rule's [level, applicable, value] entries
+// as strings, with nested lists flattened. A nil map means the file has no
+// commitlint config.
+func parseCommitlintRules(name string, data []byte) (map[string][]string, error) {
+	if name == "package.json" {
+		var pkg struct {
+			Commitlint *struct {
+				Rules map[string][]any `json:"rules"`
+			} `json:"commitlint"`
+		}
+		if err := json.Unmarshal(data, &pkg); err != nil {
+			return nil, err
+		}
+		if pkg.Commitlint == nil {
+			return nil, nil
+		}
+		return flattenCommitlintRules(pkg.Commitlint.Rules), nil
+	}
+
+	var rc struct {
+		Rules map[string][]any `json:"rules"`
+	}
+	err := json.Unmarshal(data, &rc)
+	if err == nil {
+		return flattenCommitlintRules(rc.Rules), nil
+	}
+	// .commitlintrc may be either JSON or YAML
+	if strings.HasSuffix(name, ".json") {
+		return nil, err
+	}
+	return parseCommitlintYAML(string(data)), nil
+}
+
+// flattenCommitlintRules turns JSON rule values into the same flat string
+// form as parseCommitlintYAML.
+func flattenCommitlintRules(rules map[string][]any) map[string][]string {
+	flat := make(map[string][]string)
+	var flatten func(rule string, value any)
+	flatten = func(rule string, value any) {
+		if list, ok := value.([]any); ok {
+			for _, item := range list {
+				flatten(rule, item)
 			}
+			return
+		}
+		flat[rule] = append(flat[rule], fmt.Sprint(value))
+	}
+	for rule, values := range rules {
+		for _, value := range values {
+			flatten(rule, value)
+		}
+	}
+	return flat
+}
 
-			config.Template.CustomTemplates[name] = templateStr
-			if err := saveConfig(); err != nil {
-				error_.Fprintf(os.Stderr, "Error saving config: %v\n", err)
-				os.Exit(1)
+// parseCommitlintYAML reads the rules block of a YAML commitlint config. It
+// understands the block and flow list forms commitlint documents, not YAML
+// in general.
+func parseCommitlintYAML(data string) map[string][]string {
+	rules := make(map[string][]string)
+	lines := strings.Split(data, "\n")
+	indentOf := func(line string) int {
+		return len(line) - len(strings.TrimLeft(line, " "))
+	}
+	for i := 0; i < len(lines); i++ {
+		key, rest, ok := strings.Cut(strings.TrimSpace(lines[i]), ":")
+		if !ok || (key != "type-enum" && key != "scope-enum") {
+			continue
+		}
+		// The rule's value is the rest of its line plus every deeper line
+		block := []string{rest}
+		indent := indentOf(lines[i])
+		for i+1 < len(lines) && (strings.TrimSpace(lines[i+1]) == "" || indentOf(lines[i+1]) > indent) {
+			i++
+			block = append(block, lines[i])
+		}
+		for _, line := range block {
+			line, _, _ = strings.Cut(line, "#")
+			line = strings.TrimSpace(line)
+			for strings.HasPrefix(line, "-") {
+				line = strings.TrimSpace(line[1:])
 			}
-			info.Printf("Template '%s' added successfully\n", name)
-		},
+			line = strings.NewReplacer("[", " ", "]", " ").Replace(line)
+			for _, value := range strings.Split(line, ",") {
+				if value = strings.Trim(strings.TrimSpace(value), `"'`); value != "" {
+					rules[key] = append(rules[key], value)
+				}
+			}
+		}
 	}
+	return rules
+}
 
-	// Add commands
-	templateCmd.AddCommand(addTemplateCmd)
-	configCmd.AddCommand(showConfigCmd, editConfigCmd)
-	rootCmd.AddCommand(configCmd, templateCmd)
+// commitlintEnum returns the values of an enum rule, or nothing when the rule
+// is disabled or inverted with "never".
+func commitlintEnum(rule []string) []string {
+	if len(rule) < 3 || rule[0] == "0" || rule[1] != "always" {
+		return nil
+	}
+	return rule[2:]
+}
 
-	// Initialize hooks command
-	var hooksCmd = &cobra.Command{
-		Use:   "hooks",
-		Short: "Manage git hooks",
-		Run: func(cmd *cobra.Command, args []string) {
-			if err := installGitHooks(); err != nil {
-				error_.Fprintf(os.Stderr, "Error installing git hooks: %v\n", err)
-				os.Exit(1)
+// applyProfile overlays the named AI profile on the [ai] settings.
+func applyProfile(name string) error {
+	var names []string
+	for _, profile := range config.AI.Profiles {
+		names = append(names, profile.Name)
+		if profile.Name != name {
+			continue
+		}
+		if profile.Provider != "" {
+			if err := validateProvider(profile.Provider); err != nil {
+				return fmt.Errorf("profile %s: %w", name, err)
 			}
-			info.Println("Git hooks installed successfully")
-		},
+			config.AI.Provider = profile.Provider
+		}
+		if profile.Model != "" {
+			config.AI.Model = profile.Model
+		}
+		if profile.MaxTokens > 0 {
+			config.AI.MaxTokens = profile.MaxTokens
+		}
+		if profile.Temperature != nil {
+			config.AI.Temperature = *profile.Temperature
+		}
+		debugLog("Using AI profile %s", name)
+		return nil
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("profile %q not found: no [[ai.profiles]] are configured", name)
 	}
+	return fmt.Errorf("profile %q not found (available: %s)", name, strings.Join(names, ", "))
+}
 
-	rootCmd.AddCommand(hooksCmd)
+// knownProviders lists the supported values for ai.provider.
+var knownProviders = []string{"openai", "ollama", "gemini"}
 
-	if err := rootCmd.Execute(); err != nil {
-		error_.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+func validateProvider(provider string) error {
+	for _, known := range knownProviders {
+		if provider == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported provider: %s (supported: %s)", provider, strings.Join(knownProviders, ", "))
+}
+
+// attachGenerationNote records which provider and model generated the commit
+// message in the dedicated refs/notes/zing ref. Notes don't change the hash.
+func attachGenerationNote(hash string) error {
+	note := fmt.Sprintf("Generated-by: zing\nProvider: %s\nModel: %s\nPrompt-SHA256: %s\n",
+		config.AI.Provider, config.AI.Model, promptHash)
+	output, err := exec.Command("git", "notes", "--ref=zing", "add", "-f", "-m", note, hash).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// templateNames returns the configured template names in sorted order.
+func templateNames() []string {
+	names := make([]string, 0, len(config.Template.CustomTemplates))
+	for name := range config.Template.CustomTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileNames lists the configured AI profiles in config order.
+func profileNames() []string {
+	var names []string
+	for _, profile := range config.AI.Profiles {
+		names = append(names, profile.Name)
+	}
+	return names
+}
+
+// completeFromConfig completes a flag with names read from the config. Shell
+// completion skips PersistentPreRunE, so the config is loaded here, keeping
+// any warnings off stdout where the shell reads candidates.
+func completeFromConfig(names func() []string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		color.Output = os.Stderr
+		if err := setup(); err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return names(), cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// selectTemplate makes the named template active for this run.
+func selectTemplate(name string) error {
+	if _, ok := config.Template.CustomTemplates[name]; !ok {
+		return fmt.Errorf("template %q not found (available: %s)", name, strings.Join(templateNames(), ", "))
+	}
+	config.Template.ActiveTemplate = name
+	return nil
+}
+
+// hooksDir finds the directory git runs hooks from: core.hooksPath when set
+// (as Husky does), then git's own hooks directory, then git_hooks_path from
+// the config.
+func hooksDir() string {
+	if output, err := exec.Command("git", "config", "--path", "core.hooksPath").Output(); err == nil {
+		if dir := strings.TrimSpace(string(output)); dir != "" {
+			if filepath.IsAbs(dir) {
+				return dir
+			}
+			// A relative core.hooksPath is resolved from the top of the work tree
+			if top, err := exec.Command("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+				return filepath.Join(strings.TrimSpace(string(top)), dir)
+			}
+			return dir
+		}
+	}
+	if output, err := exec.Command("git", "rev-parse", "--git-path", "hooks").Output(); err == nil {
+		if dir := strings.TrimSpace(string(output)); dir != "" {
+			return dir
+		}
 	}
+	return config.System.GitHooksPath
 }
 
-func installGitHooks() error {
+// skipHookSource reports whether prepare-commit-msg was given a message to
+// keep: one from -m or -F, a merge, a squash, or an existing commit (amend,
+// -c, -C).
+func skipHookSource(source string) bool {
+	switch source {
+	case "message", "merge", "squash", "commit":
+		return true
+	}
+	return false
+}
+
+// writeMessageFile writes message to the file git edits for the commit,
+// keeping the comment lines git already put there, such as the status
+// summary, below it.
+func writeMessageFile(path, message string) error {
+	var comments []string
+	if existing, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(existing), "\n") {
+			if strings.HasPrefix(line, "#") {
+				comments = append(comments, line)
+			}
+		}
+	}
+	content := message + "\n"
+	if len(comments) > 0 {
+		content += "\n" + strings.Join(comments, "\n") + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing commit message file: %w", err)
+	}
+	return nil
+}
+
+// zingHookMarker identifies a hook written by installGitHooks, so reinstalling
+// replaces it instead of chaining to it.
+const zingHookMarker = "# Zing pre-commit hook"
+
+// installGitHooks writes the prepare-commit-msg hook and returns its path. A
+// hook that zing did not write is kept as prepare-commit-msg.local and run
+// first.
+func installGitHooks() (string, error) {
 	hookContent := `#!/bin/sh
-# Zing pre-commit hook
-zing --yes`
+` + zingHookMarker + `
+local_hook="$(dirname "$0")/prepare-commit-msg.local"
+if [ -x "$local_hook" ]; then
+	"$local_hook" "$@" || exit $?
+fi
+exec zing --hook-mode prepare-commit-msg "$@"
+`
 
-	hookPath := filepath.Join(config.System.GitHooksPath, "prepare-commit-msg")
-	return os.WriteFile(hookPath, []byte(hookContent), 0755)
+	dir := hooksDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating hooks directory: %w", err)
+	}
+	hookPath := filepath.Join(dir, "prepare-commit-msg")
+	if existing, err := os.ReadFile(hookPath); err == nil && !strings.Contains(string(existing), zingHookMarker) {
+		localPath := hookPath + ".local"
+		if _, err := os.Stat(localPath); err == nil {
+			return "", fmt.Errorf("%s exists and is not a zing hook, and %s is already taken; merge them by hand", hookPath, localPath)
+		}
+		if err := os.Rename(hookPath, localPath); err != nil {
+			return "", fmt.Errorf("error preserving existing hook: %w", err)
+		}
+		info.Printf("Kept the existing hook as %s; zing runs it first\n", localPath)
+	}
+	if err := os.WriteFile(hookPath, []byte(hookContent), 0755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of an existing file, so set it explicitly
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(hookPath, 0755); err != nil {
+			return "", fmt.Errorf("error making hook executable: %w", err)
+		}
+	}
+	return hookPath, nil
 }
 
 func saveConfig() error {
@@ -957,8 +6080,319 @@ func saveConfig() error {
 	return encoder.Encode(config)
 }
 
+// findEditor resolves the editor command from $EDITOR, then $VISUAL, then a
+// list of common editors, skipping any that are not on PATH. The result is
+// the program followed by its arguments, e.g. ["code", "--wait"].
+func findEditor() ([]string, error) {
+	for _, name := range []string{"EDITOR", "VISUAL"} {
+		fields := strings.Fields(os.Getenv(name))
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := exec.LookPath(fields[0]); err == nil {
+			return fields, nil
+		}
+		warn.Printf("$%s is set to %q, which was not found on PATH\n", name, fields[0])
+	}
+
+	fallbacks := [][]string{{"nano"}, {"vi"}, {"code", "--wait"}}
+	if runtime.GOOS == "windows" {
+		fallbacks = append(fallbacks, []string{"notepad"})
+	}
+	for _, editor := range fallbacks {
+		if _, err := exec.LookPath(editor[0]); err == nil {
+			info.Printf("Using %s as the editor; set $EDITOR to choose another\n", strings.Join(editor, " "))
+			return editor, nil
+		}
+	}
+	return nil, fmt.Errorf("no editor found; set $EDITOR to your preferred editor")
+}
+
+// doctorCheck is one line of `zing doctor` output. A failed critical check
+// makes the command exit non-zero.
+type doctorCheck struct {
+	Name     string
+	Err      error
+	Hint     string
+	Critical bool
+}
+
+// runDoctorChecks inspects the environment zing depends on, in the order a
+// new user would have to fix things.
+func runDoctorChecks() []doctorCheck {
+	var checks []doctorCheck
+
+	_, err := exec.LookPath("git")
+	checks = append(checks, doctorCheck{"git is installed", err, "Install git from https://git-scm.com/downloads", true})
+	if err == nil {
+		_, err = exec.Command("git", "rev-parse", "--git-dir").Output()
+		if err != nil {
+			err = fmt.Errorf("not inside a git repository")
+		}
+		checks = append(checks, doctorCheck{"inside a git repository", err, "Run zing from a repository, or `git init` one", true})
+	}
+
+	err = configLoadErr
+	hint := "Run `zing config edit` to fix it, or `zing config reset` to start over"
+	checks = append(checks, doctorCheck{"config parses", err, hint, true})
+	if err == nil {
+		if problems := validateConfigFile(configFile); len(problems) > 0 {
+			err = fmt.Errorf("%d problem(s), starting with %s", len(problems), problems[0])
+		}
+		checks = append(checks, doctorCheck{"config is valid", err, "Run `zing config validate` for the full list", false})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.System.Timeout)*time.Second)
+	defer cancel()
+	err = checkProvider(ctx)
+	checks = append(checks, doctorCheck{fmt.Sprintf("provider %s is reachable", config.AI.Provider), err, providerHint(), true})
+	if err == nil && config.AI.Provider == "ollama" {
+		models, err := listOllamaModels(ctx)
+		hint := ""
+		if err == nil && !hasOllamaModel(models, config.AI.Model) {
+			err = fmt.Errorf("not pulled on %s", ollamaBaseURL())
+			hint = ollamaModelHint(config.AI.Model, models)
+		}
+		checks = append(checks, doctorCheck{fmt.Sprintf("model %s is available", config.AI.Model), err, hint, true})
+	}
+
+	_, err = findEditor()
+	checks = append(checks, doctorCheck{"an editor is available", err, "Set $EDITOR, e.g. export EDITOR=vi", false})
+
+	err = checkWritable(filepath.Dir(cache.Path))
+	checks = append(checks, doctorCheck{"cache directory is writable", err, "Fix the permissions of " + filepath.Dir(cache.Path), true})
+
+	return checks
+}
+
+// printChecks prints a ✓/✗ line per check with the hint under each failure,
+// and returns the number of failed critical checks.
+func printChecks(checks []doctorCheck) int {
+	failed := 0
+	for _, check := range checks {
+		switch {
+		case check.Err == nil:
+			info.Printf("✓ %s\n", check.Name)
+		case check.Critical:
+			failed++
+			error_.Printf("✗ %s: %v\n", check.Name, check.Err)
+			fmt.Printf("    %s\n", check.Hint)
+		default:
+			warn.Printf("! %s: %v\n", check.Name, check.Err)
+			fmt.Printf("    %s\n", check.Hint)
+		}
+	}
+	return failed
+}
+
+// runReadinessChecks covers what `zing` does before it calls the provider,
+// for the staged changes restricted to paths.
+func runReadinessChecks(paths []string) []doctorCheck {
+	var checks []doctorCheck
+
+	gitInfo, err := stagedGitInfo(paths)
+	name := "staged changes found"
+	if err == nil {
+		name = fmt.Sprintf("%d staged files to describe (+%d/-%d)", len(gitInfo.Files), gitInfo.TotalChanges.Additions, gitInfo.TotalChanges.Deletions)
+	}
+	checks = append(checks, doctorCheck{name, err, "Stage changes with `git add`, or adjust system.ignore_paths", true})
+
+	// Generation never refuses a large diff: past ai.max_prompt_tokens the
+	// smallest diffs are listed by name only, so that is only worth a warning
+	if gitInfo != nil && len(gitInfo.Files) > 0 {
+		unbounded := config
+		unbounded.AI.MaxPromptTokens = 0
+		prompt, _ := buildPrompt(gitInfo, &unbounded, explainMode)
+		tokens := estimateTokens(prompt)
+		err = nil
+		if limit := config.AI.MaxPromptTokens; limit > 0 && tokens > limit {
+			err = fmt.Errorf("over ai.max_prompt_tokens of %d; the smallest diffs will be sent as file names only", limit)
+		}
+		checks = append(checks, doctorCheck{fmt.Sprintf("prompt is about %d tokens", tokens), err, "Split the commit, or ignore generated files with system.ignore_paths", false})
+
+		// A broken filter stops generation, since the prompt is never sent unfiltered
+		if config.System.PromptFilterCommand != "" {
+			_, err = preparePrompt(gitInfo)
+			checks = append(checks, doctorCheck{"system.prompt_filter_command accepts the prompt", err, "Run the command by hand on the output of `zing preview`", true})
+		}
+	}
+
+	err = validateProvider(config.AI.Provider)
+	if err == nil && strings.TrimSpace(config.AI.Model) == "" {
+		err = fmt.Errorf("no model configured for provider %s", config.AI.Provider)
+	}
+	checks = append(checks, doctorCheck{"provider and model are configured", err, "Set ai.provider and ai.model, or run `zing doctor`", true})
+
+	_, err = commitSigningConfig()
+	checks = append(checks, doctorCheck{"commit signing is ready", err, "Set user.signingkey or turn off commit.sign", true})
+
+	return checks
+}
+
+// checkProvider makes the cheapest authenticated call the provider offers.
+func checkProvider(ctx context.Context) error {
+	switch config.AI.Provider {
+	case "ollama":
+		_, err := listOllamaModels(ctx)
+		return err
+	case "openai":
+		apiKey, err := openAIKey()
+		if err != nil {
+			return err
+		}
+		clientConfig := openai.DefaultConfig(apiKey)
+		clientConfig.HTTPClient = &http.Client{Transport: newTransport()}
+		if baseURL := openAIBaseURL(); baseURL != "" {
+			clientConfig.BaseURL = strings.TrimRight(baseURL, "/")
+		}
+		_, err = openai.NewClientWithConfig(clientConfig).ListModels(ctx)
+		return err
+	case "gemini":
+		apiKey := os.Getenv("GEMINI_API_KEY")
+		if apiKey == "" {
+			return fmt.Errorf("GEMINI_API_KEY environment variable not set")
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", geminiBaseURL+config.AI.Model, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("x-goog-api-key", apiKey)
+		client := &http.Client{Transport: newTransport()}
+		return checkResponse(client.Do(req))
+	}
+	return validateProvider(config.AI.Provider)
+}
+
+// checkResponse turns a non-200 reply into an error.
+func checkResponse(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %s from %s", resp.Status, resp.Request.URL.Redacted())
+	}
+	return nil
+}
+
+// providerHint suggests the usual fix for an unreachable provider.
+func providerHint() string {
+	switch config.AI.Provider {
+	case "ollama":
+		return "Start Ollama with `ollama serve`, or check ai.ollama.url"
+	case "openai":
+		return "Set OPENAI_API_KEY (or ai.openai.api_key_env, key_file or key_command) and check the model name"
+	case "gemini":
+		return "Set GEMINI_API_KEY and check ai.model"
+	}
+	return "Set ai.provider to one of " + strings.Join(knownProviders, ", ")
+}
+
+// listOllamaModels returns the names of the models pulled on the Ollama
+// server, such as "llama3:latest".
+func listOllamaModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", ollamaBaseURL()+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newOllamaClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request to Ollama: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ollama returned %s", resp.Status)
+	}
+
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("error decoding Ollama response: %w", err)
+	}
+	var names []string
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hasOllamaModel reports whether name is among models. Like Ollama, a name
+// without a tag means ":latest".
+func hasOllamaModel(models []string, name string) bool {
+	if !strings.Contains(name, ":") {
+		name += ":latest"
+	}
+	return slices.Contains(models, name)
+}
+
+// ollamaModelHint suggests the closest pulled model, or pulling the missing one.
+func ollamaModelHint(name string, models []string) string {
+	if closest := closestModel(name, models); closest != "" {
+		return fmt.Sprintf("Did you mean %s? Otherwise run `ollama pull %s`", closest, name)
+	}
+	return fmt.Sprintf("Run `ollama pull %s`", name)
+}
+
+// closestModel returns the model with the smallest edit distance to name,
+// ignoring models that share little with it.
+func closestModel(name string, models []string) string {
+	best, bestDistance := "", len(name)/2+1
+	for _, model := range models {
+		distance := levenshtein(name, strings.TrimSuffix(model, ":latest"))
+		if distance < bestDistance {
+			best, bestDistance = model, distance
+		}
+	}
+	return best
+}
+
+// levenshtein counts the single-character edits needed to turn a into b.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
+
+// ollamaBaseURL derives the server address from the configured chat URL,
+// e.g. http://localhost:11434 from http://localhost:11434/api/chat.
+func ollamaBaseURL() string {
+	base, _, _ := strings.Cut(config.AI.Ollama.URL, "/api/")
+	return strings.TrimRight(base, "/")
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
 func debugLog(format string, args ...interface{}) {
 	if config.Display.Debug {
-		debug.Printf("[DEBUG] "+format+"\n", args...)
+		debug.Fprintf(os.Stderr, "[DEBUG] "+format+"\n", args...)
 	}
 }